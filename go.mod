@@ -6,6 +6,7 @@ require (
 	github.com/chromedp/cdproto v0.0.0-20250803210736-d308e07a266d
 	github.com/chromedp/chromedp v0.14.2
 	github.com/jaytaylor/html2text v0.0.0-20230321000545-74c2419ad056
+	golang.org/x/net v0.10.0
 )
 
 require (
@@ -17,6 +18,5 @@ require (
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
-	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 )
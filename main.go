@@ -2,33 +2,146 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"context"
+	"debug/elf"
+	"debug/macho"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	goruntime "runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
-
+	"unicode/utf8"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/input"
+	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/cdproto/page"
 	cdpruntime "github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/security"
+	"github.com/chromedp/cdproto/storage"
 	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
 	"github.com/jaytaylor/html2text"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 const DEFAULT_TRUNCATE_AFTER = 100000
 
+// Seconds a page may take, from load through output, by default
+const DEFAULT_TIMEOUT = 60
+
+// Seconds --wait-for-manual gives a person to clear a challenge, unless
+// --timeout says otherwise
+const MANUAL_WAIT_TIMEOUT = 600
+
+// Milliseconds --wait-for waits for its element by default
+const DEFAULT_WAIT_TIMEOUT = 10000
+
+// Milliseconds without network requests --wait-network-idle waits for, and
+// without requests or DOM changes for --wait-for-idle
+const DEFAULT_NETWORK_IDLE_MS = 500
+
+// Console messages --console-buffer keeps per session tab
+const CONSOLE_BUFFER_SIZE = 1000
+
+// Levels of nested shadow roots --shadow-dom inlines by default
+const DEFAULT_SHADOW_DEPTH = 10
+
+// Common desktop screen sizes; --human picks one for the window and viewport
+var HUMAN_VIEWPORTS = []string{"1920x1080", "1536x864", "1440x900", "1366x768", "1280x800"}
+
+// Device is a phone or tablet --emulate-device presents the page as
+type Device struct {
+	Width     int
+	Height    int
+	Scale     float64
+	UserAgent string
+}
+
+// Built-in --emulate-device profiles, with CSS pixel viewports
+var DEVICES = map[string]Device{
+	"iphone-13": {390, 844, 3, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"},
+	"iphone-se": {375, 667, 2, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"},
+	"pixel-7":   {412, 915, 2.625, "Mozilla/5.0 (Linux; Android 14; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36"},
+	"galaxy-s8": {360, 740, 4, "Mozilla/5.0 (Linux; Android 9; SM-G950F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36"},
+	"ipad-air":  {820, 1180, 2, "Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"},
+}
+
+// Hardware values --random-hardware reports instead of the host's, so runs
+// from one machine don't share a fingerprint
+const RANDOM_HARDWARE_JS = `(() => {
+	Object.defineProperty(Navigator.prototype, 'hardwareConcurrency', { get: () => %d, configurable: true });
+	Object.defineProperty(Navigator.prototype, 'deviceMemory', { get: () => %d, configurable: true });
+})();`
+
 // Realistic Chrome user-agent for macOS
 const STEALTH_USER_AGENT = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
 
+// User agents tried by --retry-user-agents pool
+var RETRY_USER_AGENT_POOL = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+}
+
+// Default timezone for each --locale, by the locale's most populous zone
+var LOCALE_TIMEZONES = map[string]string{
+	"en-US": "America/New_York",
+	"en-GB": "Europe/London",
+	"en-CA": "America/Toronto",
+	"en-AU": "Australia/Sydney",
+	"en-IN": "Asia/Kolkata",
+	"de-DE": "Europe/Berlin",
+	"de-AT": "Europe/Vienna",
+	"de-CH": "Europe/Zurich",
+	"fr-FR": "Europe/Paris",
+	"fr-CA": "America/Toronto",
+	"es-ES": "Europe/Madrid",
+	"es-MX": "America/Mexico_City",
+	"it-IT": "Europe/Rome",
+	"nl-NL": "Europe/Amsterdam",
+	"pt-PT": "Europe/Lisbon",
+	"pt-BR": "America/Sao_Paulo",
+	"pl-PL": "Europe/Warsaw",
+	"sv-SE": "Europe/Stockholm",
+	"tr-TR": "Europe/Istanbul",
+	"ru-RU": "Europe/Moscow",
+	"ja-JP": "Asia/Tokyo",
+	"ko-KR": "Asia/Seoul",
+	"zh-CN": "Asia/Shanghai",
+	"zh-TW": "Asia/Taipei",
+	"hi-IN": "Asia/Kolkata",
+}
+
 // Stealth JavaScript to mask automation indicators - runs before page scripts
 const STEALTH_JS = `
 (function() {
@@ -143,7 +256,7 @@ const STEALTH_JS = `
     });
 })();
 
-// Override navigator.languages
+// Override navigator.languages (see stealthScript)
 Object.defineProperty(navigator, 'languages', {
     get: () => ['en-US', 'en'],
     configurable: true
@@ -208,8 +321,44 @@ try {
         );
     }
 } catch(e) {}
+`
 
-console.log('[stealth] Anti-detection measures applied');
+// Sets --local-storage items in the current document's origin and reports
+// whether any of them changed
+const LOCAL_STORAGE_JS = `((items) => {
+    let changed = false;
+    for (const [key, value] of items) {
+        if (localStorage.getItem(key) !== value) {
+            localStorage.setItem(key, value);
+            changed = true;
+        }
+    }
+    return changed;
+})(%s)`
+
+// Collects visible validation/error messages after a form submission
+const FORM_ERRORS_JS = `
+(() => {
+    const selectors = [
+        '[role="alert"]', '.error', '.errors', '.field-error', '.form-error',
+        '.alert-danger', '.alert-error', '.invalid-feedback', '.help-block.error',
+        '.has-error .help-block', '.flash-error', '.notice-error'
+    ];
+    const messages = [];
+    const add = (text) => {
+        text = (text || '').trim().replace(/\s+/g, ' ');
+        if (text && !messages.includes(text)) messages.push(text);
+    };
+    document.querySelectorAll(selectors.join(',')).forEach(el => {
+        if (el.offsetParent !== null) add(el.innerText);
+    });
+    document.querySelectorAll('input, select, textarea').forEach(el => {
+        if (el.willValidate && !el.checkValidity()) {
+            add((el.name || el.id || 'field') + ': ' + el.validationMessage);
+        }
+    });
+    return messages.slice(0, 20);
+})()
 `
 
 type FormInput struct {
@@ -218,21 +367,139 @@ type FormInput struct {
 }
 
 type Config struct {
-	URL            string
-	Profile        string
-	FormID         string
-	Inputs         []FormInput
-	AfterSubmitURL string
-	JSCode         string
-	ScreenshotPath string
-	TruncateAfter  int
-	RawFlag        bool
-	Headful        bool
-	WindowSize     string
-	Session        string
-	StopSession    bool
-	Stealth        bool
-	UBlock         bool
+	URL                 string
+	Profile             string
+	FormID              string
+	Inputs              []FormInput
+	AfterSubmitURL      string
+	NoSubmit            bool
+	JSCode              []string
+	ScreenshotPath      string
+	TruncateAfter       int
+	RawFlag             bool
+	Headful             bool
+	WindowSize          string
+	Viewport            string
+	DeviceScale         float64
+	EmulateDevice       string
+	DarkMode            bool
+	Session             string
+	StopSession         bool
+	ListSessions        bool
+	StopAll             bool
+	Stealth             bool
+	UBlock              bool
+	Dialog              string
+	WaitRandomMin       int
+	WaitRandomMax       int
+	Crawl               bool
+	CrawlDepth          int
+	SameOrigin          bool
+	MaxPages            int
+	Delay               int
+	Concurrency         int
+	SaveSession         string
+	ActionRetries       int
+	Retry               int
+	DetectLoginFailure  bool
+	OutputPath          string
+	OutputAppend        bool
+	Doctor              bool
+	ReinstallChromium   bool
+	ChromiumVersion     string
+	ShowVersion         bool
+	InitScripts         []string
+	FreezeTime          time.Time
+	DOMStats            bool
+	ForceHTTP           bool
+	MaxBrowsers         int
+	FallbackHeadful     bool
+	ConsoleOutputPath   string
+	ElementText         string
+	Attributes          []string
+	ExtractAttrSelector string
+	ExtractAttrName     string
+	CountSelector       string
+	Extract             []string
+	FailOnZero          bool
+	FailOnError         bool
+	ScreenshotBaseline  string
+	ScreenshotThreshold float64
+	HeaderFor           []string
+	BlockResources      string
+	ContentMetrics      bool
+	NoFlush             bool
+	ScreenshotFullPage  bool
+	SecurityReport      bool
+	TabTitle            string
+	DownloadDir         string
+	WaitForDownload     bool
+	RetryOnJSError      bool
+	MinifyHTML          bool
+	StripScripts        bool
+	CaptureCookiesPath  string
+	CookiesIn           string
+	CookiesOut          string
+	LocalStorage        []string
+	LegacyHeadless      bool
+	JSScope             string
+	RetryUserAgents     []string
+	UserAgentRetry      bool
+	UserAgent           string
+	PrettyPrintJSON     bool
+	ScreenshotStitch    bool
+	ExtractImages       bool
+	SaveImagesDir       string
+	JSONOutput          bool
+	JSONLines           bool
+	WaitFor             string
+	WaitForAny          []string
+	Clicks              []string
+	WaitNetworkIdle     bool
+	NetworkIdleMS       int
+	WaitForIdle         bool
+	TraceNavigation     bool
+	Scroll              bool
+	WaitTimeout         int
+	ProxyList           []string
+	Proxy               string
+	Timeout             int
+	Template            string
+	PDFPath             string
+	PDFLandscape        bool
+	IFrame              string
+	ScreenshotSelector  string
+	ScreenshotPadding   int
+	Human               bool
+	InputDelayMin       int
+	InputDelayMax       int
+	HumanMouse          bool
+	RandomHardware      bool
+	Cookies             []string
+	WaitForManual       string
+	Headers             []string
+	Requests            bool
+	HARPath             string
+	Links               bool
+	MaxLinks            int
+	DumpStorage         bool
+	RequestsSort        string
+	ProxyAuth           string
+	FollowCanonical     bool
+	Banner              string
+	Locale              string
+	Timezone            string
+	AcceptLanguage      string
+	ExecAfter           string
+	ShadowDOM           bool
+	ShadowDepth         int
+	ConsoleBuffer       bool
+}
+
+// PageMeta describes the page a run ended up on
+type PageMeta struct {
+	FinalURL string
+	Status   int64
 }
 
 type SessionInfo struct {
@@ -241,949 +508,7200 @@ type SessionInfo struct {
 	Headful  bool   `json:"headful"`
 	PID      int    `json:"pid"`
 	TargetID string `json:"target_id"`
+
+	// Launch-only flags the browser was started with
+	LegacyHeadless bool   `json:"legacy_headless,omitempty"`
+	UBlock         bool   `json:"ublock,omitempty"`
+	Proxy          string `json:"proxy,omitempty"`
 }
 
-func main() {
-	config := parseArgs()
+// FormResult describes the outcome of a form submission
+type FormResult struct {
+	Submitted bool     `json:"submitted"`
+	Method    string   `json:"method"`
+	Enctype   string   `json:"enctype"`
+	Navigated bool     `json:"navigated"`
+	FromURL   string   `json:"from_url"`
+	ToURL     string   `json:"to_url"`
+	Errors    []string `json:"errors"`
+
+	// Set when --detect-login-failure is enabled
+	LoginFailed    bool     `json:"login_failed,omitempty"`
+	FailureSignals []string `json:"failure_signals,omitempty"`
+}
 
-	// Handle --stop flag for session
-	if config.StopSession {
-		if config.Session == "" {
-			fmt.Fprintf(os.Stderr, "Error: --stop requires --session <id>\n")
-			os.Exit(1)
-		}
-		if err := stopSession(config.Session); err != nil {
-			fmt.Fprintf(os.Stderr, "Error stopping session: %v\n", err)
-			os.Exit(1)
+// Hides fixed and sticky elements so they don't repeat in every stitched
+// screenshot slice; RESTORE_FIXED_JS undoes it
+const HIDE_FIXED_JS = `(() => {
+	const hidden = [];
+	for (const el of document.querySelectorAll('body *')) {
+		const position = getComputedStyle(el).position;
+		if (position === 'fixed' || position === 'sticky') {
+			hidden.push([el, el.style.getPropertyValue('visibility'), el.style.getPropertyPriority('visibility')]);
+			el.style.setProperty('visibility', 'hidden', 'important');
 		}
-		fmt.Printf("Session '%s' stopped\n", config.Session)
-		return
 	}
+	window.__surfHiddenFixed = hidden;
+	return hidden.length;
+})()`
 
-	// URL is required unless we're in session mode with --js or --screenshot
-	if config.URL == "" && (config.Session == "" || (config.JSCode == "" && config.ScreenshotPath == "")) {
-		printHelp()
-		os.Exit(1)
+const RESTORE_FIXED_JS = `(() => {
+	for (const [el, value, priority] of window.__surfHiddenFixed || []) {
+		el.style.setProperty('visibility', value, priority);
 	}
+	delete window.__surfHiddenFixed;
+	return true;
+})()`
+
+// Computes page complexity stats in a single pass over the DOM, descending
+// into open shadow roots
+const DOM_STATS_JS = `
+(() => {
+    let elements = 0, depth = 0, shadowRoots = 0;
+    const stack = [[document.documentElement, 1]];
+    while (stack.length) {
+        const [el, d] = stack.pop();
+        elements++;
+        if (d > depth) depth = d;
+        if (el.shadowRoot) {
+            shadowRoots++;
+            for (const child of el.shadowRoot.children) stack.push([child, d + 1]);
+        }
+        for (const child of el.children) stack.push([child, d + 1]);
+    }
+    return {
+        elements: elements,
+        depth: depth,
+        iframes: document.querySelectorAll('iframe').length,
+        shadow_roots: shadowRoots,
+        scripts: document.scripts.length
+    };
+})()
+`
 
-	// Ensure Chromium is installed
-	err := ensureChromium()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error setting up Chromium: %v\n", err)
-		os.Exit(1)
-	}
+// ConsoleMessage is one captured console call, exception or dialog
+type ConsoleMessage struct {
+	Level     string    `json:"level"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source,omitempty"`
+}
 
-	// Ensure uBlock Origin is installed if requested
-	if config.UBlock {
-		if err := ensureUBlock(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error setting up uBlock Origin: %v\n", err)
-			os.Exit(1)
-		}
+// String renders the message the way the CONSOLE OUTPUT section shows it
+func (m ConsoleMessage) String() string {
+	return fmt.Sprintf("[%s] %s", m.Level, m.Text)
+}
+
+// PageResult is the structured form of a processed page, printed by --json
+// and rendered by --template
+type PageResult struct {
+	URL        string          `json:"url"`
+	FinalURL   string          `json:"final_url"`
+	Title      string          `json:"title"`
+	Status     int64           `json:"status,omitempty"`
+	Markdown   string          `json:"markdown,omitempty"`
+	RawHTML    string          `json:"raw_html,omitempty"`
+	Console    []ConsoleLine   `json:"console"`
+	Truncated  bool            `json:"truncated"`
+	DOMStats   *DOMStats       `json:"dom_stats,omitempty"`
+	Metrics    *ContentMetrics `json:"metrics,omitempty"`
+	Security   *SecurityReport `json:"security,omitempty"`
+	Screenshot *ScreenshotDiff `json:"screenshot_diff,omitempty"`
+	Canonical  []string        `json:"canonical,omitempty"`
+	Form       *FormResult     `json:"form,omitempty"`
+	Download   string          `json:"download,omitempty"`
+	JSResult   interface{}     `json:"js_result,omitempty"`
+	Matched    string          `json:"matched,omitempty"`
+	Navigation []NavState      `json:"navigation,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Requests   []RequestEntry  `json:"requests,omitempty"`
+	Links      []string        `json:"links,omitempty"`
+	Storage    *PageStorage    `json:"storage,omitempty"`
+}
+
+// ConsoleLine is a console message as listed in --json output
+type ConsoleLine struct {
+	Level string `json:"level"`
+	Text  string `json:"text"`
+}
+
+// ContentMetrics sizes the extracted content for --content-metrics so
+// callers can budget LLM context before using the output
+type ContentMetrics struct {
+	HTMLBytes       int  `json:"html_bytes"`
+	MarkdownChars   int  `json:"markdown_chars"`
+	OutputChars     int  `json:"output_chars"`
+	EstimatedTokens int  `json:"estimated_tokens"`
+	Truncated       bool `json:"truncated"`
+}
+
+// newContentMetrics estimates tokens at roughly four characters each
+func newContentMetrics(html, markdown, output string, truncated bool) *ContentMetrics {
+	return &ContentMetrics{
+		HTMLBytes:       len(html),
+		MarkdownChars:   len(markdown),
+		OutputChars:     len(output),
+		EstimatedTokens: (len(output) + 3) / 4,
+		Truncated:       truncated,
 	}
+}
 
-	// Process the request
-	result, err := processRequest(config)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error processing request: %v\n", err)
-		os.Exit(1)
+// lines renders the content metrics for the text output
+func (m *ContentMetrics) lines() []string {
+	return []string{
+		fmt.Sprintf("HTML size: %d bytes", m.HTMLBytes),
+		fmt.Sprintf("Markdown size: %d chars", m.MarkdownChars),
+		fmt.Sprintf("Output size: %d chars", m.OutputChars),
+		fmt.Sprintf("Estimated tokens: %d", m.EstimatedTokens),
+		fmt.Sprintf("Truncated: %t", m.Truncated),
 	}
+}
 
-	fmt.Println(result)
+// RequestEntry is one request the page made, as listed by --requests
+type RequestEntry struct {
+	Method     string  `json:"method"`
+	URL        string  `json:"url"`
+	Type       string  `json:"type"`
+	Status     int64   `json:"status,omitempty"`
+	Size       float64 `json:"size"`
+	DurationMS int64   `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+
+	started time.Time
 }
 
-func stopSession(sessionID string) error {
-	info, err := loadSession(sessionID)
-	if err != nil {
-		return fmt.Errorf("session '%s' not found", sessionID)
+// requestLog builds the --requests summary from network events
+type requestLog struct {
+	entries []*RequestEntry
+	byID    map[network.RequestID]*RequestEntry
+}
+
+func newRequestLog() *requestLog {
+	return &requestLog{byID: make(map[network.RequestID]*RequestEntry)}
+}
+
+// finish records when a request ended
+func (l *requestLog) finish(entry *RequestEntry, ts *cdp.MonotonicTime) {
+	if ts != nil && !entry.started.IsZero() {
+		entry.DurationMS = ts.Time().Sub(entry.started).Milliseconds()
 	}
+}
 
-	// Kill the browser process
-	if info.PID > 0 {
-		proc, err := os.FindProcess(info.PID)
-		if err == nil {
-			proc.Signal(os.Interrupt)
-			time.Sleep(500 * time.Millisecond)
-			proc.Kill()
+// record updates the log from a network event. A redirect ends the previous
+// hop with its redirect status and starts a new entry under the same ID
+func (l *requestLog) record(ev interface{}) {
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		if ev.Request == nil {
+			return
+		}
+		if prev, ok := l.byID[ev.RequestID]; ok && ev.RedirectResponse != nil {
+			prev.Status = ev.RedirectResponse.Status
+			prev.Size = ev.RedirectResponse.EncodedDataLength
+			l.finish(prev, ev.Timestamp)
+		}
+		entry := &RequestEntry{Method: ev.Request.Method, URL: ev.Request.URL, Type: string(ev.Type)}
+		if ev.Timestamp != nil {
+			entry.started = ev.Timestamp.Time()
+		}
+		l.entries = append(l.entries, entry)
+		l.byID[ev.RequestID] = entry
+
+	case *network.EventResponseReceived:
+		if entry, ok := l.byID[ev.RequestID]; ok && ev.Response != nil {
+			entry.Status = ev.Response.Status
+		}
+
+	case *network.EventLoadingFinished:
+		if entry, ok := l.byID[ev.RequestID]; ok {
+			entry.Size = ev.EncodedDataLength
+			l.finish(entry, ev.Timestamp)
+		}
+
+	case *network.EventLoadingFailed:
+		if entry, ok := l.byID[ev.RequestID]; ok {
+			entry.Error = ev.ErrorText
+			if ev.Canceled {
+				entry.Error = "canceled"
+			}
+			l.finish(entry, ev.Timestamp)
 		}
 	}
+}
 
-	// Remove session file
-	return removeSession(sessionID)
+// HAR is an HTTP Archive 1.2 file, as written by --har
+type HAR struct {
+	Log HARLog `json:"log"`
 }
 
-func getChromiumDir() string {
-	homeDir, _ := os.UserHomeDir()
-	return filepath.Join(homeDir, ".surf")
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Pages   []HARPage  `json:"pages"`
+	Entries []HAREntry `json:"entries"`
 }
 
-func getChromiumExec() string {
-	chromiumDir := getChromiumDir()
-	switch goruntime.GOOS {
-	case "darwin":
-		return filepath.Join(chromiumDir, "chromium", "chrome-mac", "Chromium.app", "Contents", "MacOS", "Chromium")
-	case "linux":
-		return filepath.Join(chromiumDir, "chromium", "chrome-linux", "chrome")
-	default:
-		return ""
-	}
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
 }
 
-func getSessionsDir() string {
-	return filepath.Join(getChromiumDir(), "sessions")
+type HARPage struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     HARPageTimings `json:"pageTimings"`
 }
 
-func getSessionFile(sessionID string) string {
-	return filepath.Join(getSessionsDir(), sessionID+".json")
+type HARPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
 }
 
-func saveSession(sessionID string, info SessionInfo) error {
-	sessionsDir := getSessionsDir()
-	if err := os.MkdirAll(sessionsDir, 0755); err != nil {
-		return err
-	}
-	data, err := json.Marshal(info)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(getSessionFile(sessionID), data, 0644)
+type HAREntry struct {
+	PageRef         string      `json:"pageref"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	ResourceType    string      `json:"_resourceType,omitempty"`
+	Error           string      `json:"_error,omitempty"`
 }
 
-func loadSession(sessionID string) (*SessionInfo, error) {
-	data, err := os.ReadFile(getSessionFile(sessionID))
-	if err != nil {
-		return nil, err
-	}
-	var info SessionInfo
-	if err := json.Unmarshal(data, &info); err != nil {
-		return nil, err
-	}
-	return &info, nil
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
-func removeSession(sessionID string) error {
-	return os.Remove(getSessionFile(sessionID))
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
 }
 
-// startSessionBrowser starts a Chrome process for a persistent session
-func startSessionBrowser(config Config, initialURL string) (*SessionInfo, error) {
-	chromiumExec := getChromiumExec()
-	chromiumDir := getChromiumDir()
-	profileDir := filepath.Join(chromiumDir, "profiles", config.Profile)
-	os.MkdirAll(profileDir, 0755)
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
 
-	// Find a free port for remote debugging
-	port := findFreePort()
+type HARResponse struct {
+	Status       int64          `json:"status"`
+	StatusText   string         `json:"statusText"`
+	HTTPVersion  string         `json:"httpVersion"`
+	Cookies      []HARNameValue `json:"cookies"`
+	Headers      []HARNameValue `json:"headers"`
+	Content      HARContent     `json:"content"`
+	RedirectURL  string         `json:"redirectURL"`
+	HeadersSize  int64          `json:"headersSize"`
+	BodySize     int64          `json:"bodySize"`
+	TransferSize int64          `json:"_transferSize"`
+}
 
-	args := []string{
-		fmt.Sprintf("--remote-debugging-port=%d", port),
-		fmt.Sprintf("--user-data-dir=%s", profileDir),
-		"--disable-gpu",
-		"--no-sandbox",
-		"--disable-dev-shm-usage",
-		"--disable-backgrounding-occluded-windows",
-		"--disable-renderer-backgrounding",
-		"--disable-component-extensions-with-background-pages",
-		"--disable-default-apps",
-		"--no-first-run",
-		"--disable-fre",
-	}
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
 
-	// Only disable extensions if uBlock is not requested
-	if !config.UBlock {
-		args = append(args, "--disable-extensions")
-	} else {
-		// Load uBlock Origin extension
-		args = append(args, fmt.Sprintf("--load-extension=%s", getUBlockDir()))
-	}
+// HARTimings are in milliseconds; -1 marks a phase that didn't happen
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
 
-	// Add stealth flags if enabled
-	if config.Stealth {
-		args = append(args,
-			"--disable-blink-features=AutomationControlled",
-			fmt.Sprintf("--user-agent=%s", STEALTH_USER_AGENT),
-		)
-	}
+// harRequest is one request hop as --har sees it; a redirect ends the hop
+type harRequest struct {
+	request      *network.Request
+	response     *network.Response
+	resourceType network.ResourceType
+	wallTime     time.Time
+	started      time.Time
+	ended        time.Time
+	redirectURL  string
+	bodySize     int64
+	contentSize  int64
+	transferSize int64
+	err          string
+}
 
-	if !config.Headful {
-		args = append(args, "--headless=new")
-	}
+// harLog collects network and page load events for --har
+type harLog struct {
+	requests      []*harRequest
+	byID          map[network.RequestID]*harRequest
+	onContentLoad time.Time
+	onLoad        time.Time
+}
 
-	if config.WindowSize != "" {
-		w, h := parseWindowSize(config.WindowSize)
-		args = append(args, fmt.Sprintf("--window-size=%d,%d", w, h))
-	}
+func newHARLog() *harLog {
+	return &harLog{byID: make(map[network.RequestID]*harRequest)}
+}
 
-	// Start with the initial URL (visible in the browser window)
-	args = append(args, initialURL)
+// record updates the log from a network or page event
+func (l *harLog) record(ev interface{}) {
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		if ev.Request == nil {
+			return
+		}
+		if prev, ok := l.byID[ev.RequestID]; ok && ev.RedirectResponse != nil {
+			prev.response = ev.RedirectResponse
+			prev.redirectURL = ev.Request.URL
+			prev.transferSize = int64(ev.RedirectResponse.EncodedDataLength)
+			if ev.Timestamp != nil {
+				prev.ended = ev.Timestamp.Time()
+			}
+		}
+		req := &harRequest{request: ev.Request, resourceType: ev.Type}
+		if ev.WallTime != nil {
+			req.wallTime = ev.WallTime.Time()
+		}
+		if ev.Timestamp != nil {
+			req.started = ev.Timestamp.Time()
+		}
+		l.requests = append(l.requests, req)
+		l.byID[ev.RequestID] = req
 
-	cmd := exec.Command(chromiumExec, args...)
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	// Detach process so it survives after surf exits
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
-	}
+	case *network.EventResponseReceived:
+		if req, ok := l.byID[ev.RequestID]; ok && ev.Response != nil {
+			req.response = ev.Response
+		}
 
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start browser: %v", err)
-	}
+	case *network.EventDataReceived:
+		if req, ok := l.byID[ev.RequestID]; ok {
+			req.contentSize += ev.DataLength
+			req.bodySize += ev.EncodedDataLength
+		}
 
-	// Wait for browser to be ready and get websocket URL
-	wsURL, err := waitForBrowserReady(port, 10*time.Second)
-	if err != nil {
-		cmd.Process.Kill()
-		return nil, fmt.Errorf("browser failed to start: %v", err)
-	}
+	case *network.EventLoadingFinished:
+		if req, ok := l.byID[ev.RequestID]; ok {
+			req.transferSize = int64(ev.EncodedDataLength)
+			if ev.Timestamp != nil {
+				req.ended = ev.Timestamp.Time()
+			}
+		}
 
-	// Wait a bit for the page to start loading
-	time.Sleep(1 * time.Second)
+	case *network.EventLoadingFailed:
+		if req, ok := l.byID[ev.RequestID]; ok {
+			req.err = ev.ErrorText
+			if ev.Canceled {
+				req.err = "canceled"
+			}
+			if ev.Timestamp != nil {
+				req.ended = ev.Timestamp.Time()
+			}
+		}
 
-	// Get the existing tab's target ID so we reuse it instead of creating a new tab
-	targetID, err := getFirstTargetID(port)
-	if err != nil {
-		cmd.Process.Kill()
-		return nil, fmt.Errorf("failed to get target ID: %v", err)
+	case *page.EventDomContentEventFired:
+		if ev.Timestamp != nil {
+			l.onContentLoad = ev.Timestamp.Time()
+		}
+
+	case *page.EventLoadEventFired:
+		if ev.Timestamp != nil {
+			l.onLoad = ev.Timestamp.Time()
+		}
 	}
+}
 
-	return &SessionInfo{
-		WSURL:    wsURL,
-		Profile:  config.Profile,
-		Headful:  config.Headful,
-		PID:      cmd.Process.Pid,
-		TargetID: targetID,
-	}, nil
+// har builds the archive, with the run as its only page
+func (l *harLog) har(title string) HAR {
+	const pageID = "page_1"
+	pageTimings := HARPageTimings{OnContentLoad: -1, OnLoad: -1}
+	var pageStart string
+	entries := []HAREntry{}
+	if len(l.requests) > 0 {
+		first := l.requests[0]
+		pageStart = first.wallTime.UTC().Format(time.RFC3339Nano)
+		if !l.onContentLoad.IsZero() {
+			pageTimings.OnContentLoad = milliseconds(l.onContentLoad.Sub(first.started))
+		}
+		if !l.onLoad.IsZero() {
+			pageTimings.OnLoad = milliseconds(l.onLoad.Sub(first.started))
+		}
+	}
+	for _, req := range l.requests {
+		entries = append(entries, req.entry(pageID))
+	}
+
+	return HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "surf", Version: "1.0"},
+		Pages:   []HARPage{{StartedDateTime: pageStart, ID: pageID, Title: title, PageTimings: pageTimings}},
+		Entries: entries,
+	}}
 }
 
-// getFirstTargetID gets the target ID of the first page tab from CDP
-func getFirstTargetID(port int) (string, error) {
-	url := fmt.Sprintf("http://127.0.0.1:%d/json/list", port)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
+// entry converts a request hop to a HAR entry. Requests without a response
+// (failed or still pending) get status 0 and an _error
+func (r *harRequest) entry(pageID string) HAREntry {
+	entry := HAREntry{
+		PageRef:         pageID,
+		StartedDateTime: r.wallTime.UTC().Format(time.RFC3339Nano),
+		ResourceType:    string(r.resourceType),
+		Error:           r.err,
+		Request: HARRequest{
+			Method:      r.request.Method,
+			URL:         r.request.URL + r.request.URLFragment,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(r.request.Headers),
+			QueryString: harQueryString(r.request.URL),
+			PostData:    harPostData(r.request),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: HARResponse{
+			Cookies:     []HARNameValue{},
+			Headers:     []HARNameValue{},
+			RedirectURL: r.redirectURL,
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	if entry.Request.PostData != nil {
+		entry.Request.BodySize = int64(len(entry.Request.PostData.Text))
 	}
-	defer resp.Body.Close()
 
-	var targets []struct {
-		ID   string `json:"id"`
-		Type string `json:"type"`
-		URL  string `json:"url"`
+	total := 0.0
+	if !r.ended.IsZero() && !r.started.IsZero() {
+		total = math.Max(0, milliseconds(r.ended.Sub(r.started)))
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
-		return "", err
+	entry.Timings = HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: total}
+
+	if res := r.response; res != nil {
+		version := harHTTPVersion(res.Protocol)
+		entry.Request.HTTPVersion = version
+		if res.RequestHeaders != nil {
+			entry.Request.Headers = harHeaders(res.RequestHeaders)
+		}
+		entry.Response.Status = res.Status
+		entry.Response.StatusText = res.StatusText
+		entry.Response.HTTPVersion = version
+		entry.Response.Headers = harHeaders(res.Headers)
+		entry.Response.Content = HARContent{Size: r.contentSize, MimeType: res.MimeType}
+		entry.Response.TransferSize = r.transferSize
+		if r.redirectURL == "" {
+			entry.Response.BodySize = r.bodySize
+		} else {
+			entry.Response.BodySize = 0
+		}
+		entry.ServerIPAddress = res.RemoteIPAddress
+		if res.Timing != nil {
+			entry.Timings = harTimings(res.Timing, r.ended, total)
+		}
 	}
 
-	// Find the first "page" type target
-	for _, t := range targets {
-		if t.Type == "page" {
-			return t.ID, nil
+	for _, phase := range []float64{entry.Timings.Blocked, entry.Timings.DNS, entry.Timings.Connect, entry.Timings.Send, entry.Timings.Wait, entry.Timings.Receive} {
+		if phase > 0 {
+			entry.Time += phase
 		}
 	}
-	return "", fmt.Errorf("no page target found")
+	return entry
 }
 
-func findFreePort() int {
-	// Start from a high port and find one that works
-	// The browser will bind to this port for debugging
-	return 9222 + int(time.Now().UnixNano()%1000)
+// harTimings splits a request's time into HAR phases from Chromium's
+// resource timing, whose ticks are milliseconds after RequestTime
+func harTimings(t *network.ResourceTiming, ended time.Time, total float64) HARTimings {
+	phase := func(start, end float64) float64 {
+		if start < 0 || end < 0 {
+			return -1
+		}
+		return end - start
+	}
+	timings := HARTimings{
+		DNS:     phase(t.DNSStart, t.DNSEnd),
+		Connect: phase(t.ConnectStart, t.ConnectEnd),
+		SSL:     phase(t.SslStart, t.SslEnd),
+		Send:    math.Max(0, t.SendEnd-t.SendStart),
+		Wait:    math.Max(0, t.ReceiveHeadersEnd-t.SendEnd),
+	}
+	timings.Blocked = t.SendStart
+	for _, start := range []float64{t.ConnectStart, t.DNSStart} {
+		if start >= 0 {
+			timings.Blocked = start
+		}
+	}
+	if !ended.IsZero() {
+		end := float64(ended.UnixNano())/1e6 - t.RequestTime*1000
+		timings.Receive = math.Max(0, end-t.ReceiveHeadersEnd)
+	} else {
+		timings.Receive = math.Max(0, total-t.ReceiveHeadersEnd)
+	}
+	return timings
 }
 
-func waitForBrowserReady(port int, timeout time.Duration) (string, error) {
-	deadline := time.Now().Add(timeout)
-	url := fmt.Sprintf("http://127.0.0.1:%d/json/version", port)
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
 
-	for time.Now().Before(deadline) {
-		resp, err := http.Get(url)
-		if err == nil {
-			defer resp.Body.Close()
-			var result map[string]interface{}
-			if err := json.NewDecoder(resp.Body).Decode(&result); err == nil {
-				if wsURL, ok := result["webSocketDebuggerUrl"].(string); ok {
-					return wsURL, nil
-				}
-			}
-		}
-		time.Sleep(100 * time.Millisecond)
+// harHTTPVersion names a CDP protocol the way HAR tools expect
+func harHTTPVersion(protocol string) string {
+	switch protocol {
+	case "h2":
+		return "HTTP/2"
+	case "h3":
+		return "HTTP/3"
+	case "":
+		return ""
 	}
-	return "", fmt.Errorf("timeout waiting for browser on port %d", port)
+	return strings.ToUpper(protocol)
 }
 
-func ensureChromium() error {
-	chromiumExec := getChromiumExec()
-	if chromiumExec == "" {
-		return fmt.Errorf("unsupported platform: %s", goruntime.GOOS)
+// harHeaders lists headers sorted by name
+func harHeaders(headers network.Headers) []HARNameValue {
+	list := []HARNameValue{}
+	for name, value := range headers {
+		list = append(list, HARNameValue{Name: name, Value: fmt.Sprint(value)})
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
 
-	// Check if Chromium executable exists
-	if _, err := os.Stat(chromiumExec); err == nil {
-		return nil
+// harQueryString lists a URL's query parameters in order
+func harQueryString(rawURL string) []HARNameValue {
+	list := []HARNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return list
 	}
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		name, value, _ := strings.Cut(pair, "=")
+		name, _ = url.QueryUnescape(name)
+		value, _ = url.QueryUnescape(value)
+		list = append(list, HARNameValue{Name: name, Value: value})
+	}
+	return list
+}
 
-	// Download and extract Chromium
-	fmt.Fprintln(os.Stderr, "Chromium not found, downloading...")
-
-	var chromiumUrl string
-	switch goruntime.GOOS {
-	case "darwin":
-		if goruntime.GOARCH == "arm64" {
-			chromiumUrl = "https://download-chromium.appspot.com/dl/Mac_Arm?type=snapshots"
-		} else {
-			chromiumUrl = "https://download-chromium.appspot.com/dl/Mac?type=snapshots"
+// harPostData decodes a request's body, when Chromium included it
+func harPostData(req *network.Request) *HARPostData {
+	if !req.HasPostData || len(req.PostDataEntries) == 0 {
+		return nil
+	}
+	var text strings.Builder
+	for _, entry := range req.PostDataEntries {
+		data, err := base64.StdEncoding.DecodeString(entry.Bytes)
+		if err != nil {
+			return nil
 		}
-	case "linux":
-		chromiumUrl = "https://download-chromium.appspot.com/dl/Linux_x64?type=snapshots"
+		text.Write(data)
 	}
-
-	chromiumDir := getChromiumDir()
-	err := downloadChromium(chromiumUrl, filepath.Join(chromiumDir, "chromium"))
-	if err != nil {
-		return fmt.Errorf("failed to download Chromium: %v", err)
+	mimeType := ""
+	for name, value := range req.Headers {
+		if strings.EqualFold(name, "Content-Type") {
+			mimeType = fmt.Sprint(value)
+		}
 	}
+	return &HARPostData{MimeType: mimeType, Text: text.String()}
+}
 
-	// Verify the executable exists after download
-	if _, err := os.Stat(chromiumExec); err != nil {
-		return fmt.Errorf("Chromium executable not found after download: %s", chromiumExec)
+// writeHAR saves the archive as indented JSON
+func writeHAR(path string, har HAR) error {
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
 	}
-
-	fmt.Printf("Chromium downloaded to: %s\n", chromiumDir)
-	return nil
+	return os.WriteFile(path, append(data, '\n'), 0644)
 }
 
-func getUBlockDir() string {
-	return filepath.Join(getChromiumDir(), "ublock")
+// networkIdle tracks in-flight requests for --wait-network-idle
+type networkIdle struct {
+	mu           sync.Mutex
+	inflight     map[network.RequestID]bool
+	lastActivity time.Time
 }
 
-func ensureUBlock() error {
-	uBlockDir := getUBlockDir()
-	manifestPath := filepath.Join(uBlockDir, "manifest.json")
+func newNetworkIdle() *networkIdle {
+	return &networkIdle{inflight: make(map[network.RequestID]bool), lastActivity: time.Now()}
+}
 
-	// Check if uBlock is already installed
-	if _, err := os.Stat(manifestPath); err == nil {
-		return nil
+// record updates the in-flight set from a network event. Event streams
+// never finish, so they don't count
+func (n *networkIdle) record(ev interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		if ev.Type != network.ResourceTypeEventSource {
+			n.inflight[ev.RequestID] = true
+			n.lastActivity = time.Now()
+		}
+	case *network.EventLoadingFinished:
+		n.done(ev.RequestID)
+	case *network.EventLoadingFailed:
+		n.done(ev.RequestID)
 	}
+}
 
-	fmt.Fprintln(os.Stderr, "uBlock Origin not found, downloading...")
-
-	// Download uBlock Origin Lite (uBOL) - official MV3 version
-	// https://github.com/uBlockOrigin/uBOL-home/releases
-	uBlockURL := "https://github.com/uBlockOrigin/uBOL-home/releases/download/2025.1130.1739/uBOLite_2025.1130.1739.chromium.zip"
-
-	// Create temp file
-	tempFile, err := os.CreateTemp("", "ublock-*.zip")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+func (n *networkIdle) done(id network.RequestID) {
+	if n.inflight[id] {
+		delete(n.inflight, id)
+		n.lastActivity = time.Now()
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+}
 
-	// Download
-	resp, err := http.Get(uBlockURL)
-	if err != nil {
-		return fmt.Errorf("failed to download uBlock: %v", err)
-	}
-	defer resp.Body.Close()
+// idleFor reports whether nothing has been in flight for at least quiet
+func (n *networkIdle) idleFor(quiet time.Duration) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.inflight) == 0 && time.Since(n.lastActivity) >= quiet
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download uBlock: status %d", resp.StatusCode)
+// wait blocks until the network has been quiet for the given window, giving
+// up after timeout so pages that poll forever still get extracted
+func (n *networkIdle) wait(ctx context.Context, quiet, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !n.idleFor(quiet) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			n.mu.Lock()
+			pending := len(n.inflight)
+			n.mu.Unlock()
+			return fmt.Errorf("network not idle after %s (%d request(s) still pending)", timeout, pending)
+		case <-ticker.C:
+		}
 	}
+	return nil
+}
 
-	if _, err := io.Copy(tempFile, resp.Body); err != nil {
-		return fmt.Errorf("failed to save uBlock: %v", err)
+// DOM_QUIET_JS starts watching the DOM for changes on its first call and
+// returns the milliseconds since the last one. A navigation starts over
+const DOM_QUIET_JS = `(() => {
+	if (!window.__surfDOMQuiet) {
+		const state = window.__surfDOMQuiet = {last: performance.now()};
+		new MutationObserver(() => { state.last = performance.now(); })
+			.observe(document, {subtree: true, childList: true, attributes: true, characterData: true});
 	}
-	tempFile.Close()
+	return performance.now() - window.__surfDOMQuiet.last;
+})()`
+
+// waitForIdle blocks until the network has been quiet and the DOM unchanged
+// for the same window at once, giving up after timeout like
+// networkIdle.wait. The DOM is busy while it can't be read, e.g. mid-navigation
+func waitForIdle(ctx context.Context, idle *networkIdle, quiet, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var domQuietMS float64
+		if err := chromedp.Run(ctx, chromedp.Evaluate(DOM_QUIET_JS, &domQuietMS)); err != nil {
+			domQuietMS = 0
+		}
+		networkQuiet := idle.idleFor(quiet)
+		domQuiet := time.Duration(domQuietMS*float64(time.Millisecond)) >= quiet
+		if networkQuiet && domQuiet {
+			return nil
+		}
 
-	// Extract to parent dir (zip contains uBlock0.chromium folder)
-	extractDir := filepath.Join(getChromiumDir(), "ublock")
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		return fmt.Errorf("failed to create uBlock dir: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			var busy []string
+			if !networkQuiet {
+				busy = append(busy, "network busy")
+			}
+			if !domQuiet {
+				busy = append(busy, "DOM still changing")
+			}
+			return fmt.Errorf("page not idle after %s (%s)", timeout, strings.Join(busy, ", "))
+		case <-ticker.C:
+		}
 	}
+}
 
-	if err := extractZip(tempFile.Name(), extractDir); err != nil {
-		return fmt.Errorf("failed to extract uBlock: %v", err)
-	}
+// NavState is one (url, title) state the page went through
+type NavState struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
 
-	fmt.Fprintln(os.Stderr, "uBlock Origin installed")
-	return nil
+// NAV_TRACE_BINDING is the page function NAV_TRACE_JS reports titles to
+const NAV_TRACE_BINDING = "__surfNavTrace"
+
+// NAV_TRACE_JS reports the document's title whenever it changes. Init
+// scripts run in iframes too, so frames other than the top one stay quiet
+const NAV_TRACE_JS = `(() => {
+	if (window !== window.top) return;
+	let last = null;
+	const check = () => {
+		if (document.title === last) return;
+		last = document.title;
+		try {
+			window.__surfNavTrace(JSON.stringify({url: location.href, title: document.title}));
+		} catch (e) {}
+	};
+	new MutationObserver(check).observe(document, {subtree: true, childList: true, characterData: true});
+})()`
+
+// navTrace records the main frame's URL and title changes for
+// --trace-navigation: full loads, same-document (SPA) navigations and
+// title updates. A navigation opens a state whose title is filled in by the
+// next title report for that URL, so each page shows up once with its title
+type navTrace struct {
+	mainFrame cdp.FrameID
+	states    []NavState
+	pending   bool
 }
 
-func downloadChromium(url, destDir string) error {
-	// Create destination directory
-	err := os.MkdirAll(destDir, 0755)
-	if err != nil {
-		return fmt.Errorf("could not create directory %s: %v", destDir, err)
+// navigated starts a state for a new URL, keeping the current title until
+// the page reports its own
+func (n *navTrace) navigated(url string) {
+	title := ""
+	if len(n.states) > 0 {
+		last := n.states[len(n.states)-1]
+		if last.URL == url {
+			return
+		}
+		title = last.Title
 	}
+	n.states = append(n.states, NavState{URL: url, Title: title})
+	n.pending = true
+}
 
-	// Download the zip file
-	fmt.Printf("Downloading Chromium from %s...\n", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("could not download Chromium: %v", err)
+// titled records the page's title, completing the pending state for url
+func (n *navTrace) titled(url, title string) {
+	if len(n.states) > 0 {
+		last := &n.states[len(n.states)-1]
+		if last.URL == url && (n.pending || last.Title == title) {
+			last.Title = title
+			n.pending = false
+			return
+		}
 	}
-	defer resp.Body.Close()
+	n.states = append(n.states, NavState{URL: url, Title: title})
+	n.pending = false
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+func (n *navTrace) record(ev interface{}) {
+	switch ev := ev.(type) {
+	case *page.EventFrameNavigated:
+		if ev.Frame == nil || ev.Frame.ParentID != "" {
+			return
+		}
+		n.mainFrame = ev.Frame.ID
+		n.navigated(ev.Frame.URL + ev.Frame.URLFragment)
+	case *page.EventNavigatedWithinDocument:
+		if ev.FrameID == n.mainFrame {
+			n.navigated(ev.URL)
+		}
+	case *cdpruntime.EventBindingCalled:
+		if ev.Name != NAV_TRACE_BINDING {
+			return
+		}
+		var state NavState
+		if err := json.Unmarshal([]byte(ev.Payload), &state); err == nil {
+			n.titled(state.URL, state.Title)
+		}
 	}
+}
 
-	// Create temporary file
-	tempFile, err := os.CreateTemp("", "chromium-*.zip")
-	if err != nil {
-		return fmt.Errorf("could not create temp file: %v", err)
+// navLines renders navigation states as a numbered list
+func navLines(states []NavState) []string {
+	lines := make([]string, len(states))
+	for i, s := range states {
+		title := s.Title
+		if title == "" {
+			title = "(untitled)"
+		}
+		lines[i] = fmt.Sprintf("%d. %s - %s", i+1, title, s.URL)
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	return lines
+}
 
-	// Copy download to temp file
-	_, err = io.Copy(tempFile, resp.Body)
-	if err != nil {
-		return fmt.Errorf("could not save download: %v", err)
+// sorted returns a copy of the entries in request order, or largest/slowest
+// first for --requests-sort size or duration
+func (l *requestLog) sorted(by string) []RequestEntry {
+	entries := make([]RequestEntry, len(l.entries))
+	for i, entry := range l.entries {
+		entries[i] = *entry
 	}
+	switch by {
+	case "size":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Size > entries[j].Size })
+	case "duration":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].DurationMS > entries[j].DurationMS })
+	}
+	return entries
+}
 
-	tempFile.Close()
-
-	// Extract the zip file
-	fmt.Println("Extracting Chromium...")
-	return extractZip(tempFile.Name(), destDir)
+// requestLines renders requests as a compact table for the text output
+func requestLines(entries []RequestEntry) []string {
+	lines := []string{fmt.Sprintf("%-7s %-6s %-11s %9s %8s  %s", "METHOD", "STATUS", "TYPE", "SIZE", "TIME", "URL")}
+	var total float64
+	for _, e := range entries {
+		status := strconv.FormatInt(e.Status, 10)
+		if e.Error != "" {
+			status = "ERR"
+		} else if e.Status == 0 {
+			status = "-"
+		}
+		link := e.URL
+		if len(link) > 120 {
+			link = link[:117] + "..."
+		}
+		line := fmt.Sprintf("%-7s %-6s %-11s %9s %6dms  %s", e.Method, status, e.Type, formatBytes(e.Size), e.DurationMS, link)
+		if e.Error != "" {
+			line += " (" + e.Error + ")"
+		}
+		lines = append(lines, line)
+		total += e.Size
+	}
+	lines = append(lines, fmt.Sprintf("%d requests, %s transferred", len(entries), formatBytes(total)))
+	return lines
 }
 
-func extractZip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", n/(1<<10))
 	}
-	defer r.Close()
+	return fmt.Sprintf("%.0f B", n)
+}
 
-	// Create destination directory
-	os.MkdirAll(dest, 0755)
+// SecurityReport collects --security-report findings: the page's security
+// state and certificate, mixed-content requests and the redirect chain
+type SecurityReport struct {
+	State            string   `json:"state"`
+	Issues           []string `json:"issues,omitempty"`
+	Certificate      []string `json:"certificate,omitempty"`
+	MixedContent     []string `json:"mixed_content,omitempty"`
+	Redirects        []string `json:"redirects,omitempty"`
+	InsecureRedirect bool     `json:"insecure_redirect,omitempty"`
+
+	hops []redirectHop
+}
 
-	// Extract files
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
+// redirectHop is one redirect of a document request, kept per frame so the
+// report can show only the main frame's chain
+type redirectHop struct {
+	frameID string
+	from    string
+	to      string
+	status  int64
+}
+
+// record updates the report from a security or network event
+func (r *SecurityReport) record(ev interface{}) {
+	switch ev := ev.(type) {
+	case *security.EventVisibleSecurityStateChanged:
+		state := ev.VisibleSecurityState
+		if state == nil {
+			return
+		}
+		r.State = string(state.SecurityState)
+		r.Issues = state.SecurityStateIssueIDs
+		r.Certificate = nil
+		if cert := state.CertificateSecurityState; cert != nil {
+			r.Certificate = append(r.Certificate, fmt.Sprintf("%s, issued by %s", cert.Protocol, cert.Issuer))
+			if cert.ValidTo != nil {
+				r.Certificate = append(r.Certificate, "valid until "+cert.ValidTo.Time().Format("2006-01-02"))
+			}
+			if cert.CertificateNetworkError != "" {
+				r.Certificate = append(r.Certificate, "error: "+cert.CertificateNetworkError)
+			}
+			if cert.CertificateHasWeakSignature || cert.CertificateHasSha1signature {
+				r.Certificate = append(r.Certificate, "weak signature")
+			}
+			if cert.ObsoleteSslProtocol || cert.ObsoleteSslKeyExchange || cert.ObsoleteSslCipher || cert.ObsoleteSslSignature {
+				r.Certificate = append(r.Certificate, "obsolete TLS configuration")
+			}
 		}
 
-		path := filepath.Join(dest, f.Name)
+	case *network.EventRequestWillBeSent:
+		if ev.Request == nil {
+			return
+		}
+		if t := ev.Request.MixedContentType; t != "" && t != security.MixedContentTypeNone {
+			r.MixedContent = append(r.MixedContent, fmt.Sprintf("[%s] %s", t, ev.Request.URL))
+		}
+		if ev.Type == network.ResourceTypeDocument && ev.RedirectResponse != nil {
+			r.hops = append(r.hops, redirectHop{
+				frameID: string(ev.FrameID),
+				from:    ev.RedirectResponse.URL,
+				to:      ev.Request.URL,
+				status:  ev.RedirectResponse.Status,
+			})
+		}
+	}
+}
 
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(path, f.FileInfo().Mode())
-			rc.Close()
+// finish builds the redirect chain for the main frame
+func (r *SecurityReport) finish(mainFrameID string) {
+	r.Redirects = nil
+	r.InsecureRedirect = false
+	for _, hop := range r.hops {
+		if hop.frameID != mainFrameID {
 			continue
 		}
+		r.Redirects = append(r.Redirects, fmt.Sprintf("%s (%d) -> %s", hop.from, hop.status, hop.to))
+		if strings.HasPrefix(hop.from, "https://") && strings.HasPrefix(hop.to, "http://") {
+			r.InsecureRedirect = true
+		}
+	}
+}
 
-		// Create directories for file
-		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			rc.Close()
-			return err
+// lines renders the security report for the text output
+func (r *SecurityReport) lines() []string {
+	state := r.State
+	if state == "" {
+		state = "unknown"
+	}
+	lines := []string{"Security state: " + state}
+	if len(r.Issues) > 0 {
+		lines = append(lines, "Issues: "+strings.Join(r.Issues, ", "))
+	}
+	if len(r.Certificate) > 0 {
+		lines = append(lines, "Certificate: "+strings.Join(r.Certificate, "; "))
+	}
+	if len(r.Redirects) == 0 {
+		lines = append(lines, "Redirects: none")
+	} else {
+		lines = append(lines, "Redirects:")
+		for _, redirect := range r.Redirects {
+			lines = append(lines, "  "+redirect)
+		}
+	}
+	if r.InsecureRedirect {
+		lines = append(lines, "Warning: redirected from https to http")
+	}
+	if len(r.MixedContent) == 0 {
+		lines = append(lines, "Mixed content: none")
+	} else {
+		lines = append(lines, "Mixed content:")
+		for _, request := range r.MixedContent {
+			lines = append(lines, "  "+request)
 		}
+	}
+	return lines
+}
 
-		// Create the file
-		outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.FileInfo().Mode())
-		if err != nil {
-			rc.Close()
-			return err
+// downloadTracker follows browser downloads into --download-dir so
+// --wait-for-download can block until one finishes
+type downloadTracker struct {
+	began     chan struct{}
+	beganOnce sync.Once
+	finished  chan *browser.EventDownloadProgress
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{
+		began:    make(chan struct{}),
+		finished: make(chan *browser.EventDownloadProgress, 16),
+	}
+}
+
+// record handles download events from the tab listener
+func (d *downloadTracker) record(ev interface{}) {
+	switch ev := ev.(type) {
+	case *browser.EventDownloadWillBegin:
+		d.beganOnce.Do(func() { close(d.began) })
+	case *browser.EventDownloadProgress:
+		if ev.State == browser.DownloadProgressStateCompleted || ev.State == browser.DownloadProgressStateCanceled {
+			select {
+			case d.finished <- ev:
+			default:
+			}
 		}
+	}
+}
 
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
+// wait blocks until a download completes and returns its path. It gives up
+// if no download starts within startTimeout or ctx expires first
+func (d *downloadTracker) wait(ctx context.Context, startTimeout time.Duration) (string, error) {
+	select {
+	case <-d.began:
+	case <-time.After(startTimeout):
+		return "", fmt.Errorf("no download started within %s", startTimeout)
+	case <-ctx.Done():
+		return "", fmt.Errorf("no download started: %v", ctx.Err())
+	}
 
-		if err != nil {
-			return err
+	select {
+	case ev := <-d.finished:
+		if ev.State == browser.DownloadProgressStateCanceled {
+			return "", fmt.Errorf("download was canceled")
 		}
+		return ev.FilePath, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("download did not finish: %v", ctx.Err())
 	}
+}
 
-	return nil
+// DOMStats summarizes page complexity for --dom-stats
+type DOMStats struct {
+	Elements    int `json:"elements"`
+	Depth       int `json:"depth"`
+	IFrames     int `json:"iframes"`
+	ShadowRoots int `json:"shadow_roots"`
+	Scripts     int `json:"scripts"`
+	HTMLBytes   int `json:"html_bytes"`
 }
 
-func processRequest(config Config) (string, error) {
-	var baseURL string
-	if config.URL != "" {
-		baseURL = ensureProtocol(config.URL)
+// lines renders the DOM stats for the text output
+func (d *DOMStats) lines() []string {
+	return []string{
+		fmt.Sprintf("Elements: %d", d.Elements),
+		fmt.Sprintf("Max depth: %d", d.Depth),
+		fmt.Sprintf("Iframes: %d", d.IFrames),
+		fmt.Sprintf("Shadow roots: %d", d.ShadowRoots),
+		fmt.Sprintf("Scripts: %d", d.Scripts),
+		fmt.Sprintf("HTML size: %d bytes", d.HTMLBytes),
 	}
+}
 
-	var ctx context.Context
-	var cancel context.CancelFunc
-	var allocCancel context.CancelFunc
-	isSession := config.Session != ""
-	var sessionInfo *SessionInfo
+// ScreenshotDiff is the outcome of comparing a screenshot to its baseline
+type ScreenshotDiff struct {
+	BaselinePath    string  `json:"baseline"`
+	DiffPath        string  `json:"diff,omitempty"`
+	ChangedPixels   int     `json:"changed_pixels"`
+	TotalPixels     int     `json:"total_pixels"`
+	Percent         float64 `json:"percent"`
+	SizeMismatch    string  `json:"size_mismatch,omitempty"`
+	BaselineCreated bool    `json:"baseline_created,omitempty"`
+}
 
-	if isSession {
-		// Session mode: connect to existing or start new browser
-		existingSession, err := loadSession(config.Session)
-		if err == nil {
-			// Connect to existing session
-			sessionInfo = existingSession
-			fmt.Fprintf(os.Stderr, "Connecting to session '%s'...\n", config.Session)
-		} else {
-			// Start new session browser with the initial URL
-			fmt.Fprintf(os.Stderr, "Starting new session '%s'...\n", config.Session)
-			sessionInfo, err = startSessionBrowser(config, baseURL)
-			if err != nil {
-				return "", err
-			}
-			// Save the new session immediately
-			if err := saveSession(config.Session, *sessionInfo); err != nil {
-				return "", fmt.Errorf("failed to save session: %v", err)
-			}
-		}
+// lines renders the screenshot comparison for the text output
+func (d *ScreenshotDiff) lines() []string {
+	if d.BaselineCreated {
+		return []string{fmt.Sprintf("Baseline created: %s", d.BaselinePath)}
+	}
+	lines := []string{
+		fmt.Sprintf("Baseline: %s", d.BaselinePath),
+		fmt.Sprintf("Changed: %.2f%% (%d of %d pixels)", d.Percent, d.ChangedPixels, d.TotalPixels),
+	}
+	if d.SizeMismatch != "" {
+		lines = append(lines, "Size mismatch: "+d.SizeMismatch)
+	}
+	if d.DiffPath != "" {
+		lines = append(lines, "Diff image: "+d.DiffPath)
+	}
+	return lines
+}
 
-		// Connect to the browser via websocket
-		allocCtx, allocCancelFunc := chromedp.NewRemoteAllocator(context.Background(), sessionInfo.WSURL)
-		allocCancel = allocCancelFunc
+// checkFailure is returned together with a complete result when a requested
+// check fails; main still prints the result but exits with status 2
+type checkFailure struct {
+	reason string
+}
 
-		// Attach to existing tab (we always have a target ID now)
-		ctx, cancel = chromedp.NewContext(allocCtx,
-			chromedp.WithTargetID(target.ID(sessionInfo.TargetID)))
-	} else {
-		// One-shot mode: start fresh browser that will be closed
-		chromiumExec := getChromiumExec()
-		chromiumDir := getChromiumDir()
-		profileDir := filepath.Join(chromiumDir, "profiles", config.Profile)
-		os.MkdirAll(profileDir, 0755)
+func (e *checkFailure) Error() string {
+	return e.reason
+}
 
-		opts := append(chromedp.DefaultExecAllocatorOptions[:],
-			chromedp.ExecPath(chromiumExec),
-			chromedp.UserDataDir(profileDir),
-			chromedp.Flag("headless", !config.Headful),
-			chromedp.Flag("disable-gpu", true),
-			chromedp.Flag("no-sandbox", true),
-			chromedp.Flag("disable-dev-shm-usage", true),
-			chromedp.Flag("disable-backgrounding-occluded-windows", true),
-			chromedp.Flag("disable-renderer-backgrounding", true),
-			chromedp.Flag("disable-component-extensions-with-background-pages", true),
-			chromedp.Flag("disable-default-apps", true),
-		)
-
-		// Only disable extensions if uBlock is not requested
-		if !config.UBlock {
-			opts = append(opts, chromedp.Flag("disable-extensions", true))
-		} else {
-			opts = append(opts, chromedp.Flag("load-extension", getUBlockDir()))
-		}
-
-		// Add stealth options if enabled
-		if config.Stealth {
-			opts = append(opts,
-				chromedp.Flag("disable-blink-features", "AutomationControlled"),
-				chromedp.UserAgent(STEALTH_USER_AGENT),
-			)
-		}
-
-		if config.WindowSize != "" {
-			opts = append(opts, chromedp.WindowSize(parseWindowSize(config.WindowSize)))
-		}
+// blockedPage is returned together with the headless result when the page
+// looks like a bot wall or came back blank, so --fallback-headful can retry.
+// failure is the check the page failed as well, e.g. the 403 most bot walls
+// come with, which still applies when no retry gets through
+type blockedPage struct {
+	reason  string
+	failure *checkFailure
+}
 
-		allocCtx, allocCancelFunc := chromedp.NewExecAllocator(context.Background(), opts...)
-		allocCancel = allocCancelFunc
+func (e *blockedPage) Error() string {
+	return "page looks blocked: " + e.reason
+}
 
-		ctx, cancel = chromedp.NewContext(allocCtx)
+// checkErr returns the failed check a blocked page carries, or nil
+func (e *blockedPage) checkErr() error {
+	if e.failure != nil {
+		return e.failure
 	}
+	return nil
+}
 
-	// Set up timeout
-	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 60*time.Second)
-	defer timeoutCancel()
-	ctx = timeoutCtx
-
-	// Console message capture
-	var consoleMessages []string
-	var consoleMu sync.Mutex
-
-	// Listen for console events
-	chromedp.ListenTarget(ctx, func(ev interface{}) {
-		switch ev := ev.(type) {
-		case *cdpruntime.EventConsoleAPICalled:
-			consoleMu.Lock()
-			defer consoleMu.Unlock()
+// afterRetry decides between a retry of a blocked page and the blocked page
+// itself. A retry that ran stands, even one failing a check; one that errored
+// falls back to the blocked page's output, which still fails its checks
+func afterRetry(blocked *blockedPage, retryErr error) (bool, error) {
+	var retryFailure *checkFailure
+	if retryErr == nil || errors.As(retryErr, &retryFailure) {
+		return false, retryErr
+	}
+	return true, blocked.checkErr()
+}
 
-			level := strings.ToUpper(string(ev.Type))
-			if level == "LOG" {
-				level = "LOG"
-			} else if level == "WARNING" {
-				level = "WARNING"
-			} else if level == "ERROR" {
-				level = "ERROR"
-			}
+// lines renders the form result for the text output
+func (r *FormResult) lines() []string {
+	lines := []string{
+		fmt.Sprintf("Submitted: %t (%s, %s)", r.Submitted, r.Method, r.Enctype),
+		fmt.Sprintf("Navigated: %t (%s -> %s)", r.Navigated, r.FromURL, r.ToURL),
+	}
+	if len(r.Errors) == 0 {
+		lines = append(lines, "Errors: none detected")
+	} else {
+		lines = append(lines, "Errors:")
+		for _, msg := range r.Errors {
+			lines = append(lines, "- "+msg)
+		}
+	}
+	if r.LoginFailed {
+		lines = append(lines, "Login: likely FAILED ("+strings.Join(r.FailureSignals, "; ")+")")
+	} else if len(r.FailureSignals) > 0 {
+		lines = append(lines, "Login: no failure detected, though "+strings.Join(r.FailureSignals, "; "))
+	}
+	return lines
+}
 
-			var msgParts []string
-			for _, arg := range ev.Args {
-				val := ""
-				if arg.Value != nil {
-					// Properly unmarshal JSON value
-					var strVal string
-					if err := json.Unmarshal(arg.Value, &strVal); err == nil {
-						val = strVal
-					} else {
-						// Fallback: try as raw value (numbers, booleans, etc.)
-						val = strings.Trim(string(arg.Value), "\"")
-					}
-				} else if arg.Description != "" {
-					val = arg.Description
-				}
-				if val != "" {
-					msgParts = append(msgParts, val)
-				}
-			}
-			if len(msgParts) > 0 {
-				consoleMessages = append(consoleMessages, fmt.Sprintf("[%s] %s", level, strings.Join(msgParts, " ")))
-			}
+func main() {
+	config := parseArgs()
 
-		case *cdpruntime.EventExceptionThrown:
-			consoleMu.Lock()
-			defer consoleMu.Unlock()
-			if ev.ExceptionDetails != nil {
-				msg := ev.ExceptionDetails.Text
-				if ev.ExceptionDetails.Exception != nil && ev.ExceptionDetails.Exception.Description != "" {
-					msg = ev.ExceptionDetails.Exception.Description
-				}
-				consoleMessages = append(consoleMessages, fmt.Sprintf("[ERROR] %s", msg))
-			}
+	// Handle --stop flag for session
+	if config.StopSession {
+		if config.Session == "" {
+			fmt.Fprintf(os.Stderr, "Error: --stop requires --session <id>\n")
+			os.Exit(1)
 		}
-	})
-
-	// Inject stealth JS before navigation if enabled (runs before any page scripts)
-	if config.Stealth {
-		err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
-			_, err := page.AddScriptToEvaluateOnNewDocument(STEALTH_JS).Do(ctx)
-			return err
-		}))
-		if err != nil {
-			// Non-fatal, log and continue
-			fmt.Fprintf(os.Stderr, "Warning: Could not inject stealth script: %v\n", err)
+		if err := stopSession(config.Session); err != nil {
+			fmt.Fprintf(os.Stderr, "Error stopping session: %v\n", err)
+			os.Exit(1)
 		}
+		fmt.Fprintf(os.Stderr, "Session '%s' stopped\n", config.Session)
+		return
 	}
 
-	// Navigate to page (skip if no URL in session mode - just use current page)
-	var err error
-	if baseURL != "" {
-		err = chromedp.Run(ctx, chromedp.Navigate(baseURL))
+	if config.StopAll {
+		stopped, stale, err := stopAllSessions(getSessionsDir())
 		if err != nil {
-			return "", fmt.Errorf("could not navigate to %s: %v", baseURL, err)
+			fmt.Fprintf(os.Stderr, "Error stopping sessions: %v\n", err)
+			os.Exit(1)
 		}
+		fmt.Fprintf(os.Stderr, "Stopped %d session(s), removed %d stale session file(s)\n", stopped, stale)
+		return
+	}
 
-		// Wait for page to load
-		err = chromedp.Run(ctx, chromedp.WaitReady("body"))
+	if config.ListSessions {
+		sessions, err := listSessions(getSessionsDir())
 		if err != nil {
-			return "", fmt.Errorf("page did not load: %v", err)
+			fmt.Fprintf(os.Stderr, "Error listing sessions: %v\n", err)
+			os.Exit(1)
 		}
+		if len(sessions) == 0 {
+			fmt.Fprintf(os.Stderr, "No sessions\n")
+			return
+		}
+		fmt.Print(formatSessionTable(sessions))
+		if stale := countStaleSessions(sessions); stale > 0 {
+			fmt.Fprintf(os.Stderr, "%d stale session file(s); remove them with --session <id> --stop\n", stale)
+		}
+		return
 	}
 
-	// Detect LiveView pages
-	var isLiveView bool
-	err = chromedp.Run(ctx, chromedp.Evaluate(`document.querySelector('[data-phx-session]') !== null`, &isLiveView))
-	if err != nil {
-		isLiveView = false
-	}
-
-	if isLiveView {
-		fmt.Println("Detected Phoenix LiveView page, waiting for connection...")
-		// Wait for Phoenix LiveView to connect
-		err = waitForSelector(ctx, ".phx-connected", 10*time.Second)
-		if err != nil {
-			fmt.Printf("Warning: Could not detect LiveView connection: %v\n", err)
-		} else {
-			fmt.Println("Phoenix LiveView connected")
+	if config.ChromiumVersion != "" {
+		if _, err := strconv.Atoi(config.ChromiumVersion); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --chromium-version must be a numeric snapshot revision\n")
+			os.Exit(1)
 		}
 	}
 
-	// Handle form submission if specified
-	if config.FormID != "" && len(config.Inputs) > 0 {
-		err = handleForm(ctx, config, isLiveView)
-		if err != nil {
-			return "", fmt.Errorf("error handling form: %v", err)
+	if config.ShowVersion {
+		revision := getInstalledRevision(config.ChromiumVersion)
+		if revision == "" {
+			revision = "unknown"
 		}
+		fmt.Printf("Chromium revision: %s\n", revision)
+		fmt.Printf("Chromium path: %s\n", getChromiumExec(config.ChromiumVersion))
+		return
 	}
 
-	// Execute JavaScript if provided
-	if config.JSCode != "" {
-		// Store current URL before executing JS
-		var currentURL string
-		chromedp.Run(ctx, chromedp.Location(&currentURL))
-
-		var result interface{}
-		err = chromedp.Run(ctx, chromedp.Evaluate(config.JSCode, &result))
-		if err != nil {
-			fmt.Printf("Warning: JavaScript execution failed: %v\n", err)
+	if config.Doctor {
+		if !runDoctor(config.ChromiumVersion) {
+			os.Exit(1)
 		}
+		return
+	}
 
-		// Wait for navigation based on page type
-		if isLiveView {
-			fmt.Println("Waiting for Phoenix LiveView navigation...")
-			time.Sleep(500 * time.Millisecond)
-
-			var newURL string
-			chromedp.Run(ctx, chromedp.Location(&newURL))
-			if newURL != currentURL {
-				fmt.Println("URL changed, waiting for page to stabilize...")
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				fmt.Println("Info: No navigation detected (in-place LiveView update)")
-			}
-		} else {
-			fmt.Println("Waiting for page navigation...")
-			time.Sleep(200 * time.Millisecond)
-
-			var newURL string
-			chromedp.Run(ctx, chromedp.Location(&newURL))
+	if config.Dialog != "accept" && config.Dialog != "dismiss" {
+		fmt.Fprintf(os.Stderr, "Error: --dialog must be 'accept' or 'dismiss'\n")
+		os.Exit(1)
+	}
 
-			if newURL != currentURL {
-				fmt.Println("Navigation detected, waiting for page load...")
-				err = chromedp.Run(ctx, chromedp.WaitReady("body"))
-				if err != nil {
-					fmt.Printf("Warning: Page load wait timed out: %v\n", err)
-				} else {
-					fmt.Println("Page load completed")
-				}
-			} else {
-				fmt.Println("Info: No navigation detected (page update without URL change)")
-			}
-		}
+	if config.Viewport != "" && !sizeRe.MatchString(config.Viewport) {
+		fmt.Fprintf(os.Stderr, "Error: --viewport must be <width>x<height> in pixels (e.g. 1440x900)\n")
+		os.Exit(1)
 	}
 
-	// Take screenshot if requested
-	if config.ScreenshotPath != "" {
-		var screenshot []byte
-		err = chromedp.Run(ctx, chromedp.FullScreenshot(&screenshot, 100))
-		if err != nil {
-			return "", fmt.Errorf("error taking screenshot: %v", err)
+	if config.SaveSession != "" {
+		if config.Session != "" || config.Crawl {
+			fmt.Fprintf(os.Stderr, "Error: --save-session cannot be combined with --session or --crawl\n")
+			os.Exit(1)
 		}
-		err = os.WriteFile(config.ScreenshotPath, screenshot, 0644)
-		if err != nil {
-			return "", fmt.Errorf("error saving screenshot: %v", err)
+		var busy *sessionNotResponding
+		if _, err := loadLiveSession(config.SaveSession); err == nil || errors.As(err, &busy) {
+			fmt.Fprintf(os.Stderr, "Error: session '%s' already exists (stop it first with --session %s --stop)\n", config.SaveSession, config.SaveSession)
+			os.Exit(1)
 		}
-		fmt.Printf("Screenshot saved to %s\n", config.ScreenshotPath)
 	}
 
-	// Navigate to after-submit URL if provided
-	if config.AfterSubmitURL != "" {
-		fmt.Printf("Navigating to after-submit URL: %s\n", config.AfterSubmitURL)
-		err = chromedp.Run(ctx, chromedp.Navigate(config.AfterSubmitURL))
-		if err != nil {
-			return "", fmt.Errorf("could not navigate to after-submit URL: %v", err)
+	for _, spec := range config.Attributes {
+		if _, _, err := parseAttributeSpec(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-		chromedp.Run(ctx, chromedp.WaitReady("body"))
 	}
 
-	// Get page content
-	var content string
-	err = chromedp.Run(ctx, chromedp.OuterHTML("html", &content))
-	if err != nil {
-		return "", fmt.Errorf("could not get page content: %v", err)
+	for _, spec := range config.HeaderFor {
+		if _, err := parseHeaderFor(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Return raw HTML if requested
-	if config.RawFlag {
-		return content, nil
+	if _, err := parseResourceTypes(config.BlockResources); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Convert HTML to markdown
-	text, err := html2text.FromString(content)
-	if err != nil {
-		return "", fmt.Errorf("could not convert HTML to text: %v", err)
+	if (config.MinifyHTML || config.StripScripts) && !config.RawFlag {
+		fmt.Fprintf(os.Stderr, "Error: --minify-html and --strip-scripts only apply to --raw output\n")
+		os.Exit(1)
+	}
+	if config.StripScripts && !config.MinifyHTML {
+		fmt.Fprintf(os.Stderr, "Error: --strip-scripts requires --minify-html\n")
+		os.Exit(1)
 	}
 
-	// Clean and format the markdown
-	markdown := cleanMarkdown(text)
+	if config.JSScope != "" && len(config.JSCode) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: --js-in requires --js <code>\n")
+		os.Exit(1)
+	}
 
-	// Truncate if specified
-	if len(markdown) > config.TruncateAfter {
-		markdown = markdown[:config.TruncateAfter] + fmt.Sprintf("\n\n... (output truncated after %d chars, full content was %d chars)", config.TruncateAfter, len(text))
+	for _, spec := range config.LocalStorage {
+		if _, _, err := parseStorageSpec(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Get current URL for the header (in case we didn't navigate, e.g. session with --js only)
-	displayURL := baseURL
-	if displayURL == "" {
-		chromedp.Run(ctx, chromedp.Location(&displayURL))
+	if config.CookiesIn != "" {
+		if _, err := readCookies(config.CookiesIn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --cookies-in: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Add header with URL and console messages
-	result := fmt.Sprintf("==========================\n%s\n==========================\n\n%s", displayURL, markdown)
+	if config.CaptureCookiesPath != "" && config.FormID == "" {
+		fmt.Fprintf(os.Stderr, "Error: --capture-cookies requires --form\n")
+		os.Exit(1)
+	}
 
-	// Add console messages if any
-	consoleMu.Lock()
-	if len(consoleMessages) > 0 {
-		result += "\n\n" + strings.Repeat("=", 50) + "\nCONSOLE OUTPUT:\n" + strings.Repeat("=", 50) + "\n"
-		for _, msg := range consoleMessages {
-			result += msg + "\n"
+	if config.NoSubmit {
+		if config.FormID == "" {
+			fmt.Fprintf(os.Stderr, "Error: --no-submit requires --form\n")
+			os.Exit(1)
+		}
+		if config.AfterSubmitURL != "" || config.DetectLoginFailure || config.CaptureCookiesPath != "" {
+			fmt.Fprintf(os.Stderr, "Error: --no-submit cannot be combined with --after-submit, --detect-login-failure or --capture-cookies\n")
+			os.Exit(1)
 		}
 	}
-	consoleMu.Unlock()
 
-	if isSession {
-		// Session mode: keep browser and tab running
-		// Don't call cancel() as it may close the tab
-		// Just let the context go out of scope
-		_ = cancel
-		_ = allocCancel
-	} else {
-		// One-shot mode: close browser
-		// Navigate away to trigger localStorage flush before shutdown
-		chromedp.Run(ctx, chromedp.Navigate("about:blank"))
-		time.Sleep(100 * time.Millisecond)
+	if config.WaitForDownload && config.DownloadDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: --wait-for-download requires --download-dir <path>\n")
+		os.Exit(1)
+	}
 
-		// Explicitly cancel context to ensure browser shuts down
-		timeoutCancel()
-		cancel()
-		// Wait for browser process to fully exit and flush data
-		time.Sleep(500 * time.Millisecond)
-		allocCancel()
+	if config.TabTitle != "" && config.Session == "" {
+		fmt.Fprintf(os.Stderr, "Error: --tab-title requires --session <id>\n")
+		os.Exit(1)
 	}
 
-	return result, nil
-}
+	if len(config.ProxyList) > 0 && (config.Session != "" || config.SaveSession != "") {
+		fmt.Fprintf(os.Stderr, "Error: --proxy-list cannot be combined with --session or --save-session\n")
+		os.Exit(1)
+	}
 
-// waitForSelector waits for an element matching the selector to appear
-func waitForSelector(ctx context.Context, selector string, timeout time.Duration) error {
-	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	return chromedp.Run(timeoutCtx, chromedp.WaitVisible(selector))
-}
+	if config.Proxy != "" && len(config.ProxyList) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: --proxy cannot be combined with --proxy-list\n")
+		os.Exit(1)
+	}
 
-func handleForm(ctx context.Context, config Config, isLiveView bool) error {
-	// Fill form inputs
-	for _, input := range config.Inputs {
-		selector := fmt.Sprintf("#%s input[name='%s']", config.FormID, input.Name)
+	if config.Crawl && config.MaxBrowsers > 0 && len(config.ProxyList) > config.MaxBrowsers {
+		fmt.Fprintf(os.Stderr, "Error: --proxy-list runs one browser per proxy, so its %d proxies need --max-browsers %d or more\n", len(config.ProxyList), len(config.ProxyList))
+		os.Exit(1)
+	}
 
-		err := chromedp.Run(ctx,
-			chromedp.WaitVisible(selector),
-			chromedp.Clear(selector),
-			chromedp.SendKeys(selector, input.Value),
-		)
-		if err != nil {
-			return fmt.Errorf("could not fill input %s: %v", input.Name, err)
+	if config.ProxyAuth != "" {
+		if !strings.Contains(config.ProxyAuth, ":") {
+			fmt.Fprintf(os.Stderr, "Error: --proxy-auth must be user:pass\n")
+			os.Exit(1)
+		}
+		if config.Proxy == "" && len(config.ProxyList) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: --proxy-auth requires --proxy or --proxy-list\n")
+			os.Exit(1)
 		}
 	}
 
-	formSelector := fmt.Sprintf("#%s", config.FormID)
+	// A single page has nothing to rotate, so it uses the first proxy
+	if len(config.ProxyList) > 0 && !config.Crawl {
+		config.Proxy = config.ProxyList[0]
+		fmt.Fprintf(os.Stderr, "Using proxy %s\n", config.Proxy)
+	}
 
-	if isLiveView {
-		// For LiveView, submit by pressing Enter
-		fmt.Println("Waiting for Phoenix LiveView navigation...")
-		err := chromedp.Run(ctx, chromedp.SendKeys(formSelector, "\r"))
-		if err != nil {
-			return fmt.Errorf("could not submit LiveView form: %v", err)
+	if config.Template != "" {
+		if config.JSONOutput {
+			fmt.Fprintf(os.Stderr, "Error: --template cannot be combined with --json\n")
+			os.Exit(1)
+		}
+		if _, err := parseOutputTemplate(config.Template); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --template: %v\n", err)
+			os.Exit(1)
 		}
+	}
 
-		// Wait for LiveView to process
-		time.Sleep(500 * time.Millisecond)
-		fmt.Println("LiveView form submitted")
-	} else {
-		// For regular forms, try submit button first, then Enter
-		submitSelector := fmt.Sprintf("#%s input[type='submit'], #%s button[type='submit']", config.FormID, config.FormID)
+	if config.ConsoleBuffer && config.Session == "" {
+		fmt.Fprintf(os.Stderr, "Error: --console-buffer requires --session\n")
+		os.Exit(1)
+	}
 
-		var nodes []*cdpruntime.RemoteObject
-		err := chromedp.Run(ctx, chromedp.Evaluate(
-			fmt.Sprintf(`document.querySelectorAll("%s").length`, submitSelector),
-			&nodes,
-		))
+	if config.Locale != "" && !localeRe.MatchString(config.Locale) {
+		fmt.Fprintf(os.Stderr, "Error: --locale must look like xx or xx-YY (e.g. de-DE)\n")
+		os.Exit(1)
+	}
 
-		var submitCount int
-		chromedp.Run(ctx, chromedp.Evaluate(
-			fmt.Sprintf(`document.querySelectorAll("%s").length`, submitSelector),
-			&submitCount,
-		))
+	if config.AcceptLanguage != "" && len(languageList(config.AcceptLanguage)) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: --accept-language must list languages (e.g. \"fr-FR,fr;q=0.9,en;q=0.8\")\n")
+		os.Exit(1)
+	}
+
+	if config.Timezone != "" {
+		if _, err := time.LoadLocation(config.Timezone); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --timezone must be an IANA zone like Europe/Berlin: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.SaveImagesDir != "" && config.RawFlag {
+		fmt.Fprintf(os.Stderr, "Error: --save-images rewrites the markdown's image links, so it cannot be combined with --raw\n")
+		os.Exit(1)
+	}
+
+	if config.ExecAfter != "" && config.Crawl {
+		fmt.Fprintf(os.Stderr, "Error: --exec-after cannot be combined with --crawl\n")
+		os.Exit(1)
+	}
+
+	if config.HARPath != "" && config.Crawl {
+		fmt.Fprintf(os.Stderr, "Error: --har cannot be combined with --crawl\n")
+		os.Exit(1)
+	}
+
+	if config.JSONOutput && config.Crawl && !config.JSONLines {
+		fmt.Fprintf(os.Stderr, "Error: --json cannot be combined with --crawl; use --jsonl for one object per page\n")
+		os.Exit(1)
+	}
+
+	if config.WaitForManual != "" && !config.Headful {
+		headfulSession := false
+		if config.Session != "" {
+			if info, err := loadLiveSession(config.Session); err == nil {
+				headfulSession = info.Headful
+			}
+		}
+		if !headfulSession {
+			fmt.Fprintf(os.Stderr, "Error: --wait-for-manual needs a visible browser; add --headful or use a --session started with --headful\n")
+			os.Exit(1)
+		}
+	}
+
+	if config.Banner != "" && config.Banner != "box" && config.Banner != "markdown" && config.Banner != "none" {
+		fmt.Fprintf(os.Stderr, "Error: --banner must be 'box', 'markdown' or 'none'\n")
+		os.Exit(1)
+	}
+
+	if config.RequestsSort != "" {
+		if !config.Requests {
+			fmt.Fprintf(os.Stderr, "Error: --requests-sort requires --requests\n")
+			os.Exit(1)
+		}
+		if config.RequestsSort != "size" && config.RequestsSort != "duration" {
+			fmt.Fprintf(os.Stderr, "Error: --requests-sort must be 'size' or 'duration'\n")
+			os.Exit(1)
+		}
+	}
+
+	if config.PDFLandscape && config.PDFPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --pdf-landscape requires --pdf <path>\n")
+		os.Exit(1)
+	}
+
+	if config.PDFPath != "" && config.Headful {
+		fmt.Fprintf(os.Stderr, "Error: --pdf only works headless; Chromium can't print to PDF in a visible window\n")
+		os.Exit(1)
+	}
+
+	if config.ScreenshotSelector != "" {
+		if config.ScreenshotPath == "" {
+			fmt.Fprintf(os.Stderr, "Error: --screenshot-selector requires --screenshot <filepath>\n")
+			os.Exit(1)
+		}
+		if config.ScreenshotFullPage || config.ScreenshotStitch {
+			fmt.Fprintf(os.Stderr, "Error: --screenshot-selector cannot be combined with --screenshot-full-page or --stitch\n")
+			os.Exit(1)
+		}
+	}
+
+	if config.ScreenshotPadding > 0 && config.ScreenshotSelector == "" {
+		fmt.Fprintf(os.Stderr, "Error: --screenshot-padding requires --screenshot-selector <css>\n")
+		os.Exit(1)
+	}
+
+	if config.ScreenshotStitch && config.ScreenshotPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --stitch requires --screenshot <filepath>\n")
+		os.Exit(1)
+	}
+
+	if config.ScreenshotBaseline != "" && config.ScreenshotPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --screenshot-baseline requires --screenshot <filepath>\n")
+		os.Exit(1)
+	}
+
+	if config.OutputAppend && config.OutputPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --output-append requires --output <path>\n")
+		os.Exit(1)
+	}
+
+	if config.ReinstallChromium {
+		if err := reinstallChromium(config.ChromiumVersion); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reinstalling Chromium: %v\n", err)
+			os.Exit(1)
+		}
+		// Reinstalling on its own is a complete command
+		if config.URL == "" && config.Session == "" {
+			return
+		}
+	}
+
+	// URL is required unless we're in session mode with --js or --screenshot
+	if config.URL == "" && (config.Session == "" || (len(config.JSCode) == 0 && len(config.Clicks) == 0 && config.ScreenshotPath == "")) {
+		printHelp()
+		os.Exit(1)
+	}
+
+	// Ensure Chromium is installed
+	err := ensureChromium(config.ChromiumVersion)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up Chromium: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Ensure uBlock Origin is installed if requested
+	if config.UBlock {
+		if err := ensureUBlock(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting up uBlock Origin: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Wait for a free slot when the number of concurrent browsers is capped
+	if config.MaxBrowsers > 0 {
+		release, err := acquireBrowserSlot(config.MaxBrowsers)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error acquiring browser slot: %v\n", err)
+			os.Exit(1)
+		}
+		defer release()
+	}
+
+	if config.Crawl {
+		if config.URL == "" {
+			fmt.Fprintf(os.Stderr, "Error: --crawl requires a seed URL\n")
+			os.Exit(1)
+		}
+		out, err := openOutput(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+		if err := crawl(config, out); err != nil {
+			fmt.Fprintf(os.Stderr, "Error crawling: %v\n", err)
+			os.Exit(1)
+		}
+		if config.OutputPath != "" {
+			fmt.Fprintf(os.Stderr, "Output saved to %s\n", config.OutputPath)
+		}
+		return
+	}
+
+	// Process the request
+	result, meta, err := processRequest(config)
+	var failure *checkFailure
+	if err != nil && !errors.As(err, &failure) {
+		fmt.Fprintf(os.Stderr, "Error processing request: %v\n", err)
+		os.Exit(1)
+	}
+
+	// With --exec-after the command's output takes the result's place on
+	// stdout; an --output file is still written
+	if config.ExecAfter == "" || config.OutputPath != "" {
+		if err := writeResult(config, result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.ExecAfter != "" {
+		if meta.FinalURL == "" {
+			meta.FinalURL = ensureProtocol(config.URL)
+		}
+		if err := runExecAfter(config.ExecAfter, result, meta, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --exec-after command failed: %v\n", err)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+				os.Exit(exitErr.ExitCode())
+			}
+			os.Exit(1)
+		}
+	}
+
+	if failure != nil {
+		fmt.Fprintf(os.Stderr, "Check failed: %v\n", failure)
+		os.Exit(2)
+	}
+}
+
+// openOutput returns the destination for results: stdout, or the --output
+// file, truncated or appended to with --output-append
+func openOutput(config Config) (*os.File, error) {
+	if config.OutputPath == "" {
+		return os.Stdout, nil
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if config.OutputAppend {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	return os.OpenFile(config.OutputPath, flags, 0644)
+}
+
+// runExecAfter runs command through the shell with the result on its stdin
+// and the page's URL and HTTP status in SURF_URL and SURF_STATUS. The
+// command's stdout goes to out and its stderr passes through
+func runExecAfter(command, result string, meta PageMeta, out io.Writer) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(result + "\n")
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	status := ""
+	if meta.Status > 0 {
+		status = strconv.FormatInt(meta.Status, 10)
+	}
+	cmd.Env = append(os.Environ(), "SURF_URL="+meta.FinalURL, "SURF_STATUS="+status)
+	return cmd.Run()
+}
+
+// writeResult prints the result to stdout, or writes it to the --output file.
+// The result is the only thing surf writes to stdout; progress and status
+// messages go to stderr so they never mix into the page content
+func writeResult(config Config, result string) error {
+	if config.OutputPath == "" {
+		fmt.Println(result)
+		return nil
+	}
+
+	out, err := openOutput(config)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := fmt.Fprintln(out, result); err != nil {
+		return err
+	}
+	// Keep a blank line between results accumulated across invocations,
+	// except in JSON Lines files
+	if config.OutputAppend && !config.JSONLines {
+		fmt.Fprintln(out)
+	}
+
+	fmt.Fprintf(os.Stderr, "Output saved to %s\n", config.OutputPath)
+	return nil
+}
+
+func stopSession(sessionID string) error {
+	info, err := loadSession(sessionID)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("session '%s' not found", sessionID)
+	}
+	if err != nil {
+		// An unreadable file names no browser to stop, so just clear it
+		fmt.Fprintf(os.Stderr, "Session file for '%s' is unreadable (%v); removing it\n", sessionID, err)
+		return removeSession(sessionID)
+	}
+
+	// Kill the browser process, unless it already exited and the PID may
+	// belong to something else by now
+	if processAlive(info.PID) {
+		killBrowser(info.PID)
+	}
+	if info.TargetID != "" {
+		os.Remove(consoleBufferFile(info.TargetID))
+	}
+
+	// Remove session file
+	return removeSession(sessionID)
+}
+
+// stopAllSessions stops every session in dir and removes its file. Sessions
+// whose browser already exited only have their stale file removed
+func stopAllSessions(dir string) (stopped, stale int, err error) {
+	sessions, err := listSessions(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, s := range sessions {
+		if s.Alive {
+			killBrowser(s.Info.PID)
+		}
+		if s.Info.TargetID != "" {
+			os.Remove(consoleBufferFile(s.Info.TargetID))
+		}
+		if err := os.Remove(filepath.Join(dir, s.ID+".json")); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: Could not remove session file for '%s': %v\n", s.ID, err)
+			continue
+		}
+		if s.Alive {
+			stopped++
+		} else {
+			stale++
+		}
+	}
+	return stopped, stale, nil
+}
+
+// killBrowser interrupts a session browser process, then force-kills it
+func killBrowser(pid int) {
+	if pid <= 0 {
+		return
+	}
+	proc, err := os.FindProcess(pid)
+	if err == nil {
+		proc.Signal(os.Interrupt)
+		time.Sleep(500 * time.Millisecond)
+		proc.Kill()
+	}
+}
+
+func getChromiumDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".surf")
+}
+
+// getChromiumInstallDir returns where a Chromium snapshot is installed; the
+// latest snapshot lives in ~/.surf/chromium, pinned revisions alongside it
+func getChromiumInstallDir(revision string) string {
+	if revision == "" {
+		return filepath.Join(getChromiumDir(), "chromium")
+	}
+	return filepath.Join(getChromiumDir(), "chromium-"+revision)
+}
+
+func getChromiumExec(revision string) string {
+	installDir := getChromiumInstallDir(revision)
+	switch goruntime.GOOS {
+	case "darwin":
+		return filepath.Join(installDir, "chrome-mac", "Chromium.app", "Contents", "MacOS", "Chromium")
+	case "linux":
+		return filepath.Join(installDir, "chrome-linux", "chrome")
+	default:
+		return ""
+	}
+}
+
+// getInstalledRevision reads the revision recorded when Chromium was downloaded
+func getInstalledRevision(revision string) string {
+	data, err := os.ReadFile(filepath.Join(getChromiumInstallDir(revision), "REVISION"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func getLocksDir() string {
+	return filepath.Join(getChromiumDir(), "locks")
+}
+
+// acquireBrowserSlot blocks until one of limit slot lockfiles in ~/.surf/locks
+// can be locked, limiting concurrent browsers across surf processes. Locks
+// are released by the returned func or automatically when the process exits.
+func acquireBrowserSlot(limit int) (func(), error) {
+	locksDir := getLocksDir()
+	if err := os.MkdirAll(locksDir, 0755); err != nil {
+		return nil, err
+	}
+
+	waiting := false
+	for {
+		for slot := 0; slot < limit; slot++ {
+			f, err := os.OpenFile(filepath.Join(locksDir, fmt.Sprintf("slot-%d.lock", slot)), os.O_CREATE|os.O_RDWR, 0644)
+			if err != nil {
+				return nil, err
+			}
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+				return func() {
+					syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+					f.Close()
+				}, nil
+			}
+			f.Close()
+		}
+
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Waiting for a free browser slot (max %d)...\n", limit)
+			waiting = true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func getSessionsDir() string {
+	return filepath.Join(getChromiumDir(), "sessions")
+}
+
+func getSessionFile(sessionID string) string {
+	return filepath.Join(getSessionsDir(), sessionID+".json")
+}
+
+func saveSession(sessionID string, info SessionInfo) error {
+	sessionsDir := getSessionsDir()
+	if err := os.MkdirAll(sessionsDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getSessionFile(sessionID), data, 0644)
+}
+
+func loadSession(sessionID string) (*SessionInfo, error) {
+	data, err := os.ReadFile(getSessionFile(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	var info SessionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func removeSession(sessionID string) error {
+	return os.Remove(getSessionFile(sessionID))
+}
+
+// sessionNotResponding is returned for a session whose browser is still
+// running but doesn't answer on its debugging port, e.g. while it is busy.
+// Its file is kept, since starting another browser on the same profile
+// would fail
+type sessionNotResponding struct {
+	id  string
+	pid int
+}
+
+func (e *sessionNotResponding) Error() string {
+	return fmt.Sprintf("session '%s' is running (PID %d) but not responding; try again, or stop it with --session %s --stop", e.id, e.pid, e.id)
+}
+
+// loadLiveSession loads a session only if its browser is still running and
+// answering on its debugging port. A stale file left by a crash or reboot is
+// removed and reported as missing, so a fresh session can take its place
+func loadLiveSession(sessionID string) (*SessionInfo, error) {
+	info, err := loadSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !processAlive(info.PID) {
+		fmt.Fprintf(os.Stderr, "Session '%s' is no longer running; removing its stale session file\n", sessionID)
+		removeSession(sessionID)
+		if info.TargetID != "" {
+			os.Remove(consoleBufferFile(info.TargetID))
+		}
+		return nil, fmt.Errorf("session '%s' is no longer running", sessionID)
+	}
+	if !sessionReachable(*info) {
+		return nil, &sessionNotResponding{sessionID, info.PID}
+	}
+	return info, nil
+}
+
+// sessionReachable reports whether a session's browser process is alive and
+// its DevTools endpoint responds
+func sessionReachable(info SessionInfo) bool {
+	if !processAlive(info.PID) {
+		return false
+	}
+	wsURL, err := url.Parse(info.WSURL)
+	if err != nil || wsURL.Host == "" {
+		return false
+	}
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + wsURL.Host + "/json/version")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// SessionStatus is a saved session and whether its browser is still running
+type SessionStatus struct {
+	ID    string
+	Info  SessionInfo
+	Alive bool
+	Err   error
+}
+
+// listSessions loads every session file in dir, sorted by id. A file that
+// can't be read or parsed is still listed, with Err set, so it can be cleaned up
+func listSessions(dir string) ([]SessionStatus, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var sessions []SessionStatus
+	for _, path := range paths {
+		status := SessionStatus{ID: strings.TrimSuffix(filepath.Base(path), ".json")}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &status.Info)
+		}
+		if err != nil {
+			status.Err = err
+		} else {
+			status.Alive = processAlive(status.Info.PID)
+		}
+		sessions = append(sessions, status)
+	}
+	return sessions, nil
+}
+
+// processAlive reports whether pid is a running process; signal 0 checks
+// for existence without delivering anything
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// formatSessionTable lays out sessions as an aligned table
+func formatSessionTable(sessions []SessionStatus) string {
+	rows := [][]string{{"SESSION", "PROFILE", "PID", "HEADFUL", "STATUS"}}
+	for _, s := range sessions {
+		status := "alive"
+		if s.Err != nil {
+			status = "invalid (stale)"
+		} else if !s.Alive {
+			status = "dead (stale)"
+		}
+		headful := "no"
+		if s.Info.Headful {
+			headful = "yes"
+		}
+		pid := "-"
+		if s.Info.PID > 0 {
+			pid = strconv.Itoa(s.Info.PID)
+		}
+		profile := s.Info.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		rows = append(rows, []string{s.ID, profile, pid, headful, status})
+	}
+
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	var b strings.Builder
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(row)-1 {
+				b.WriteString(cell)
+			} else {
+				fmt.Fprintf(&b, "%-*s  ", widths[i], cell)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// countStaleSessions counts sessions whose browser is gone or whose file is unreadable
+func countStaleSessions(sessions []SessionStatus) int {
+	stale := 0
+	for _, s := range sessions {
+		if !s.Alive {
+			stale++
+		}
+	}
+	return stale
+}
+
+// startSessionBrowser starts a Chrome process for a persistent session
+func startSessionBrowser(config Config, initialURL string) (*SessionInfo, error) {
+	chromiumExec := getChromiumExec(config.ChromiumVersion)
+	chromiumDir := getChromiumDir()
+	profileDir := filepath.Join(chromiumDir, "profiles", config.Profile)
+	os.MkdirAll(profileDir, 0755)
+
+	// Find a free port for remote debugging
+	port, err := findFreePort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free debugging port: %v", err)
+	}
+
+	args := []string{
+		fmt.Sprintf("--remote-debugging-port=%d", port),
+		fmt.Sprintf("--user-data-dir=%s", profileDir),
+		"--disable-gpu",
+		"--no-sandbox",
+		"--disable-dev-shm-usage",
+		"--disable-backgrounding-occluded-windows",
+		"--disable-renderer-backgrounding",
+		"--disable-component-extensions-with-background-pages",
+		"--disable-default-apps",
+		"--no-first-run",
+		"--disable-fre",
+	}
+
+	// Only disable extensions if uBlock is not requested
+	if !config.UBlock {
+		args = append(args, "--disable-extensions")
+	} else {
+		// Load uBlock Origin extension
+		args = append(args, fmt.Sprintf("--load-extension=%s", getUBlockDir()))
+	}
+
+	// Add stealth flags if enabled; an explicit user agent wins over stealth's
+	if config.Stealth {
+		args = append(args, "--disable-blink-features=AutomationControlled")
+		if config.UserAgent == "" {
+			args = append(args, fmt.Sprintf("--user-agent=%s", STEALTH_USER_AGENT))
+		}
+	}
+	if config.UserAgent != "" {
+		args = append(args, fmt.Sprintf("--user-agent=%s", config.UserAgent))
+	}
+
+	if !config.Headful {
+		args = append(args, "--headless="+headlessMode(config))
+	}
+
+	if config.WindowSize != "" {
+		w, h := parseWindowSize(config.WindowSize)
+		args = append(args, fmt.Sprintf("--window-size=%d,%d", w, h))
+	}
+
+	if config.Proxy != "" {
+		args = append(args, "--proxy-server="+config.Proxy)
+	}
+
+	// Start with the initial URL (visible in the browser window)
+	args = append(args, initialURL)
+
+	cmd := exec.Command(chromiumExec, args...)
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	// Detach process so it survives after surf exits
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start browser: %v", err)
+	}
+
+	// Wait for browser to be ready and get websocket URL
+	wsURL, err := waitForBrowserReady(port, 10*time.Second)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("browser failed to start: %v", err)
+	}
+
+	// Wait a bit for the page to start loading
+	time.Sleep(1 * time.Second)
+
+	// Get the existing tab's target ID so we reuse it instead of creating a new tab
+	targetID, err := getFirstTargetID(port)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("failed to get target ID: %v", err)
+	}
+
+	return &SessionInfo{
+		WSURL:          wsURL,
+		Profile:        config.Profile,
+		Headful:        config.Headful,
+		PID:            cmd.Process.Pid,
+		TargetID:       targetID,
+		LegacyHeadless: config.LegacyHeadless,
+		UBlock:         config.UBlock,
+		Proxy:          config.Proxy,
+	}, nil
+}
+
+// getFirstTargetID gets the target ID of the first page tab from CDP
+func getFirstTargetID(port int) (string, error) {
+	url := fmt.Sprintf("http://127.0.0.1:%d/json/list", port)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var targets []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+		return "", err
+	}
+
+	// Find the first "page" type target
+	for _, t := range targets {
+		if t.Type == "page" {
+			return t.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no page target found")
+}
+
+// findTabByTitle returns the ID of the single page target in the browser at
+// wsURL whose title or URL contains query (case-insensitive)
+func findTabByTitle(wsURL, query string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, err := chromedp.NewBrowser(ctx, wsURL)
+	if err != nil {
+		return "", fmt.Errorf("could not connect to session browser: %v", err)
+	}
+	infos, err := target.GetTargets().Do(cdp.WithExecutor(ctx, b))
+	if err != nil {
+		return "", fmt.Errorf("could not list tabs: %v", err)
+	}
+	return matchTab(infos, query)
+}
+
+// matchTab picks the single page target whose title or URL contains query
+// (case-insensitive). No match, or several, is an error listing what to do
+func matchTab(infos []*target.Info, query string) (string, error) {
+	needle := strings.ToLower(query)
+	var matches []*target.Info
+	for _, info := range infos {
+		if info.Type != "page" {
+			continue
+		}
+		if strings.Contains(strings.ToLower(info.Title), needle) || strings.Contains(strings.ToLower(info.URL), needle) {
+			matches = append(matches, info)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no tab title or URL contains %q", query)
+	case 1:
+		return string(matches[0].TargetID), nil
+	default:
+		var tabs []string
+		for _, info := range matches {
+			tabs = append(tabs, fmt.Sprintf("  %s (%s)", info.Title, info.URL))
+		}
+		return "", fmt.Errorf("%d tabs match %q, be more specific:\n%s", len(matches), query, strings.Join(tabs, "\n"))
+	}
+}
+
+// findFreePort asks the OS for an unused local port for the browser's
+// debugging endpoint, so concurrent sessions never pick the same one
+func findFreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitForBrowserReady(port int, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	url := fmt.Sprintf("http://127.0.0.1:%d/json/version", port)
+
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url)
+		if err == nil {
+			defer resp.Body.Close()
+			var result map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err == nil {
+				if wsURL, ok := result["webSocketDebuggerUrl"].(string); ok {
+					return wsURL, nil
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return "", fmt.Errorf("timeout waiting for browser on port %d", port)
+}
+
+func ensureChromium(revision string) error {
+	chromiumExec := getChromiumExec(revision)
+	if chromiumExec == "" {
+		return fmt.Errorf("unsupported platform: %s", goruntime.GOOS)
+	}
+
+	// Check if Chromium executable exists
+	if _, err := os.Stat(chromiumExec); err == nil {
+		return nil
+	}
+
+	// Download and extract Chromium
+	fmt.Fprintln(os.Stderr, "Chromium not found, downloading...")
+
+	installDir := getChromiumInstallDir(revision)
+	err := downloadChromium(getChromiumURL(revision), installDir)
+	if err != nil {
+		return fmt.Errorf("failed to download Chromium: %v", err)
+	}
+
+	// Verify the executable exists after download
+	if _, err := os.Stat(chromiumExec); err != nil {
+		return fmt.Errorf("Chromium executable not found after download: %s", chromiumExec)
+	}
+
+	fmt.Fprintf(os.Stderr, "Chromium downloaded to: %s\n", installDir)
+	return nil
+}
+
+// getChromiumURL returns the snapshot download URL for this platform, either
+// the latest snapshot or a specific revision
+func getChromiumURL(revision string) string {
+	var platform, archive string
+	switch goruntime.GOOS {
+	case "darwin":
+		platform, archive = "Mac", "chrome-mac.zip"
+		if goruntime.GOARCH == "arm64" {
+			platform = "Mac_Arm"
+		}
+	case "linux":
+		platform, archive = "Linux_x64", "chrome-linux.zip"
+	}
+
+	if revision == "" {
+		return fmt.Sprintf("https://download-chromium.appspot.com/dl/%s?type=snapshots", platform)
+	}
+	return fmt.Sprintf("https://storage.googleapis.com/chromium-browser-snapshots/%s/%s/%s", platform, revision, archive)
+}
+
+// snapshotRevision extracts the revision from a chromium-browser-snapshots
+// download URL such as .../chromium-browser-snapshots/Linux_x64/1234567/chrome-linux.zip
+func snapshotRevision(downloadURL *url.URL) string {
+	parts := strings.Split(downloadURL.Path, "/")
+	for i, part := range parts {
+		if part == "chromium-browser-snapshots" && i+2 < len(parts) {
+			return parts[i+2]
+		}
+	}
+	return ""
+}
+
+// runDoctor checks the surf installation and reports each check's status,
+// returning false if any check failed
+func runDoctor(revision string) bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("[FAIL] %s: %v\n", name, err)
+			ok = false
+		} else {
+			fmt.Printf("[OK]   %s\n", name)
+		}
+	}
+
+	fmt.Printf("surf health check (%s/%s)\n\n", goruntime.GOOS, goruntime.GOARCH)
+
+	chromiumExec := getChromiumExec(revision)
+	if chromiumExec == "" {
+		report("Supported platform", fmt.Errorf("unsupported platform: %s", goruntime.GOOS))
+		return false
+	}
+	report("Supported platform", nil)
+
+	report("Write access to "+getChromiumDir(), checkWritable(getChromiumDir()))
+
+	if _, err := os.Stat(chromiumExec); err != nil {
+		report("Chromium installed at "+chromiumExec, fmt.Errorf("not found (run surf --reinstall-chromium to download it)"))
+		return false
+	}
+	report("Chromium installed at "+chromiumExec, nil)
+
+	report("Chromium architecture matches "+goruntime.GOARCH, checkChromiumArch(chromiumExec))
+
+	version, err := checkChromiumLaunch(chromiumExec)
+	if err == nil {
+		report("Chromium launches headless ("+version+")", nil)
+	} else {
+		report("Chromium launches headless", err)
+	}
+
+	if ok {
+		fmt.Println("\nAll checks passed")
+	} else {
+		fmt.Println("\nSome checks failed")
+	}
+	return ok
+}
+
+// checkWritable verifies that files can be created in dir
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkChromiumArch verifies the Chromium binary was built for this CPU
+func checkChromiumArch(path string) error {
+	var want, got string
+	switch goruntime.GOOS {
+	case "linux":
+		f, err := elf.Open(path)
+		if err != nil {
+			return fmt.Errorf("not a valid ELF binary: %v", err)
+		}
+		defer f.Close()
+		wants := map[string]elf.Machine{"amd64": elf.EM_X86_64, "arm64": elf.EM_AARCH64}
+		want, got = wants[goruntime.GOARCH].String(), f.Machine.String()
+	case "darwin":
+		wants := map[string]macho.Cpu{"amd64": macho.CpuAmd64, "arm64": macho.CpuArm64}
+		want = wants[goruntime.GOARCH].String()
+		if fat, err := macho.OpenFat(path); err == nil {
+			defer fat.Close()
+			for _, arch := range fat.Arches {
+				if arch.Cpu.String() == want {
+					return nil
+				}
+			}
+			got = "universal binary without " + want
+		} else {
+			f, err := macho.Open(path)
+			if err != nil {
+				return fmt.Errorf("not a valid Mach-O binary: %v", err)
+			}
+			defer f.Close()
+			got = f.Cpu.String()
+		}
+	}
+	if want != got {
+		return fmt.Errorf("binary is %s, expected %s", got, want)
+	}
+	return nil
+}
+
+// checkChromiumLaunch starts Chromium headless with a throwaway profile and
+// returns its product version
+func checkChromiumLaunch(path string) (string, error) {
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.ExecPath(path),
+		chromedp.Flag("disable-gpu", true),
+		chromedp.Flag("no-sandbox", true),
+		chromedp.Flag("disable-dev-shm-usage", true),
+	)
+	allocCtx, allocCancel := chromedp.NewExecAllocator(context.Background(), opts...)
+	defer allocCancel()
+	ctx, cancel := chromedp.NewContext(allocCtx)
+	defer cancel()
+	ctx, timeoutCancel := context.WithTimeout(ctx, 30*time.Second)
+	defer timeoutCancel()
+
+	var product string
+	err := chromedp.Run(ctx,
+		chromedp.Navigate("about:blank"),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			_, product, _, _, _, err = browser.GetVersion().Do(ctx)
+			return err
+		}),
+	)
+	return product, err
+}
+
+// reinstallChromium removes the downloaded Chromium and downloads it again,
+// then validates the fresh copy
+func reinstallChromium(revision string) error {
+	chromiumDir := getChromiumInstallDir(revision)
+	fmt.Fprintf(os.Stderr, "Removing %s...\n", chromiumDir)
+	if err := os.RemoveAll(chromiumDir); err != nil {
+		return fmt.Errorf("could not remove %s: %v", chromiumDir, err)
+	}
+
+	// The zip's CRC checksums are verified during extraction
+	if err := ensureChromium(revision); err != nil {
+		return err
+	}
+
+	if err := checkChromiumArch(getChromiumExec(revision)); err != nil {
+		return fmt.Errorf("downloaded Chromium is invalid: %v", err)
+	}
+	fmt.Fprintln(os.Stderr, "Chromium reinstalled")
+	return nil
+}
+
+func getUBlockDir() string {
+	return filepath.Join(getChromiumDir(), "ublock")
+}
+
+func ensureUBlock() error {
+	uBlockDir := getUBlockDir()
+	manifestPath := filepath.Join(uBlockDir, "manifest.json")
+
+	// Check if uBlock is already installed
+	if _, err := os.Stat(manifestPath); err == nil {
+		return nil
+	}
+
+	fmt.Fprintln(os.Stderr, "uBlock Origin not found, downloading...")
+
+	// Download uBlock Origin Lite (uBOL) - official MV3 version
+	// https://github.com/uBlockOrigin/uBOL-home/releases
+	uBlockURL := "https://github.com/uBlockOrigin/uBOL-home/releases/download/2025.1130.1739/uBOLite_2025.1130.1739.chromium.zip"
+
+	// Create temp file
+	tempFile, err := os.CreateTemp("", "ublock-*.zip")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	// Download
+	resp, err := http.Get(uBlockURL)
+	if err != nil {
+		return fmt.Errorf("failed to download uBlock: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download uBlock: status %d", resp.StatusCode)
+	}
+
+	if _, err := io.Copy(tempFile, resp.Body); err != nil {
+		return fmt.Errorf("failed to save uBlock: %v", err)
+	}
+	tempFile.Close()
+
+	// Extract to parent dir (zip contains uBlock0.chromium folder)
+	extractDir := filepath.Join(getChromiumDir(), "ublock")
+	if err := os.MkdirAll(extractDir, 0755); err != nil {
+		return fmt.Errorf("failed to create uBlock dir: %v", err)
+	}
+
+	if err := extractZip(tempFile.Name(), extractDir); err != nil {
+		return fmt.Errorf("failed to extract uBlock: %v", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "uBlock Origin installed")
+	return nil
+}
+
+func downloadChromium(url, destDir string) error {
+	// Create destination directory
+	err := os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory %s: %v", destDir, err)
+	}
+
+	// Download the zip file
+	fmt.Fprintf(os.Stderr, "Downloading Chromium from %s...\n", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("could not download Chromium: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	// Create temporary file
+	tempFile, err := os.CreateTemp("", "chromium-*.zip")
+	if err != nil {
+		return fmt.Errorf("could not create temp file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	// Copy download to temp file
+	_, err = io.Copy(tempFile, resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not save download: %v", err)
+	}
+
+	tempFile.Close()
+
+	// Extract the zip file
+	fmt.Fprintln(os.Stderr, "Extracting Chromium...")
+	if err := extractZip(tempFile.Name(), destDir); err != nil {
+		return err
+	}
+
+	// Record the revision (the latest-snapshot URL redirects to a revisioned one)
+	if revision := snapshotRevision(resp.Request.URL); revision != "" {
+		os.WriteFile(filepath.Join(destDir, "REVISION"), []byte(revision+"\n"), 0644)
+	}
+	return nil
+}
+
+func extractZip(src, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Create destination directory
+	os.MkdirAll(dest, 0755)
+
+	// Extract files
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, f.Name)
+
+		if f.FileInfo().IsDir() {
+			os.MkdirAll(path, f.FileInfo().Mode())
+			rc.Close()
+			continue
+		}
+
+		// Create directories for file
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			rc.Close()
+			return err
+		}
+
+		// Create the file
+		outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.FileInfo().Mode())
+		if err != nil {
+			rc.Close()
+			return err
+		}
+
+		_, err = io.Copy(outFile, rc)
+		outFile.Close()
+		rc.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func processRequest(config Config) (string, PageMeta, error) {
+	var baseURL string
+	if config.URL != "" {
+		baseURL = ensureProtocol(config.URL)
+	}
+
+	var ctx context.Context
+	var cancel, allocCancel context.CancelFunc
+	var savedSession *SessionInfo
+	var err error
+	if config.SaveSession != "" {
+		// Launch a detached browser so it can outlive this run, and only
+		// register it as a session once the run succeeds
+		savedSession, err = startSessionBrowser(config, baseURL)
+		if err != nil {
+			return "", PageMeta{}, err
+		}
+		ctx, cancel, allocCancel = connectSession(savedSession)
+	} else {
+		ctx, cancel, allocCancel, err = openBrowser(config, baseURL)
+		if err != nil {
+			return "", PageMeta{}, err
+		}
+	}
+	isSession := config.Session != ""
+
+	// Set up timeout
+	browserCtx := ctx
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+	defer timeoutCancel()
+	ctx = timeoutCtx
+
+	result, meta, err := processPage(ctx, config, baseURL)
+	var failure *checkFailure
+	var blocked *blockedPage
+	if err != nil && !errors.As(err, &failure) && !errors.As(err, &blocked) {
+		if savedSession != nil {
+			killBrowser(savedSession.PID)
+		}
+		return "", meta, err
+	}
+
+	if savedSession != nil {
+		// Promote the one-shot browser to a named session
+		if err := saveSession(config.SaveSession, *savedSession); err != nil {
+			killBrowser(savedSession.PID)
+			return "", meta, fmt.Errorf("failed to save session: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Browser kept open as session '%s' (use --session %s)\n", config.SaveSession, config.SaveSession)
+	} else if isSession {
+		// Session mode: keep browser and tab running
+		// Don't call cancel() as it may close the tab
+		// Just let the context go out of scope
+		_ = cancel
+		_ = allocCancel
+	} else {
+		// One-shot mode: close browser. The page timeout may already have
+		// fired, so the flush runs on the browser context with its own limit.
+		// --no-flush skips it and just kills the browser
+		timeoutCancel()
+		if !config.NoFlush {
+			closeBrowser(browserCtx)
+		}
+		cancel()
+		allocCancel()
+	}
+
+	if blocked != nil && len(config.RetryUserAgents) > 0 {
+		// Try the next user agent; once the list runs out a blocked page
+		// falls through to --fallback-headful, if set
+		retryConfig := config
+		retryConfig.UserAgent = config.RetryUserAgents[0]
+		retryConfig.RetryUserAgents = config.RetryUserAgents[1:]
+		retryConfig.UserAgentRetry = true
+		fmt.Fprintf(os.Stderr, "Page looks blocked (%s), retrying with user agent: %s\n", blocked.reason, retryConfig.UserAgent)
+		retryResult, retryMeta, err := processRequest(retryConfig)
+		if fallback, blockedErr := afterRetry(blocked, err); fallback {
+			fmt.Fprintf(os.Stderr, "Warning: retry failed (%v), using the blocked page output\n", err)
+			return result, meta, blockedErr
+		}
+		return retryResult, retryMeta, err
+	}
+	if config.UserAgentRetry && blocked == nil {
+		fmt.Fprintf(os.Stderr, "Output produced with user agent: %s\n", config.UserAgent)
+	}
+
+	if blocked != nil && config.FallbackHeadful && !config.Headful {
+		// The headless browser is closed by now, so the profile is free
+		fmt.Fprintf(os.Stderr, "Headless run looks blocked (%s), retrying headful...\n", blocked.reason)
+		retryConfig := config
+		retryConfig.Headful = true
+		retryConfig.FallbackHeadful = false
+		retryResult, retryMeta, err := processRequest(retryConfig)
+		if fallback, blockedErr := afterRetry(blocked, err); fallback {
+			fmt.Fprintf(os.Stderr, "Warning: headful retry failed (%v), output produced in headless mode\n", err)
+			return result, meta, blockedErr
+		}
+		fmt.Fprintln(os.Stderr, "Output produced in headful mode")
+		return retryResult, retryMeta, err
+	}
+	if config.FallbackHeadful && !config.Headful && !isSession && savedSession == nil {
+		fmt.Fprintln(os.Stderr, "Output produced in headless mode")
+	}
+	if blocked != nil {
+		fmt.Fprintf(os.Stderr, "Warning: page still looks blocked (%s)\n", blocked.reason)
+		return result, meta, blocked.checkErr()
+	}
+
+	if failure != nil {
+		return result, meta, failure
+	}
+	return result, meta, nil
+}
+
+// closeBrowser shuts down a one-shot browser without losing profile data.
+// Navigating to about:blank unloads the page so its storage is committed,
+// and a graceful Browser.close lets Chrome flush the profile; chromedp.Cancel
+// then waits for the process to exit instead of killing it
+func closeBrowser(ctx context.Context) {
+	closeCtx, closeCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer closeCancel()
+
+	if err := chromedp.Run(closeCtx, chromedp.Navigate("about:blank")); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not unload page before closing: %v\n", err)
+	}
+	if err := chromedp.Cancel(closeCtx); err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Warning: Browser did not close cleanly: %v\n", err)
+	}
+}
+
+// crawl fetches the seed URL and follows its links breadth-first up to
+// config.CrawlDepth, writing each page's result to out as soon as it completes
+func crawl(config Config, out io.Writer) error {
+	seed := stripFragment(ensureProtocol(config.URL))
+	seedURL, err := url.Parse(seed)
+	if err != nil {
+		return fmt.Errorf("invalid seed URL %s: %v", seed, err)
+	}
+
+	browsers := newCrawlBrowsers(config, seed)
+	defer browsers.close()
+
+	// Fail early if the first browser can't start
+	if _, err := browsers.browser(0); err != nil {
+		return err
+	}
+
+	visited := map[string]bool{seed: true}
+	frontier := []string{seed}
+	pages := 0
+	var outMu sync.Mutex
+
+	for depth := 0; depth <= config.CrawlDepth && len(frontier) > 0 && pages < config.MaxPages; depth++ {
+		if pages+len(frontier) > config.MaxPages {
+			frontier = frontier[:config.MaxPages-pages]
+		}
+		pages += len(frontier)
+
+		var next []string
+		var nextMu sync.Mutex
+		jobs := make(chan string)
+		var wg sync.WaitGroup
+
+		for w := 0; w < config.Concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for pageURL := range jobs {
+					isSeed := pageURL == seed
+					if !isSeed && config.Delay > 0 {
+						time.Sleep(time.Duration(config.Delay) * time.Millisecond)
+					}
+
+					browserCtx, proxy, err := browsers.get()
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: Could not crawl %s: %v\n", pageURL, err)
+						continue
+					}
+					// --save-images downloads go through this browser's proxy too
+					proxyConfig := config
+					if proxy != "" {
+						fmt.Fprintf(os.Stderr, "Crawling %s via proxy %s\n", pageURL, proxy)
+						proxyConfig.Proxy = proxy
+					}
+
+					result, links, err := crawlPage(browserCtx, proxyConfig, pageURL, isSeed)
+
+					outMu.Lock()
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: Could not crawl %s: %v\n", pageURL, err)
+						// Keep one line per page, failed ones included
+						if config.JSONLines {
+							if line, err := encodePageResult(config, PageResult{URL: pageURL, Console: []ConsoleLine{}, Error: err.Error()}); err == nil {
+								fmt.Fprintln(out, line)
+							}
+						}
+					} else if config.JSONLines {
+						fmt.Fprintln(out, result)
+					} else {
+						fmt.Fprintln(out, result)
+						fmt.Fprintln(out)
+					}
+					outMu.Unlock()
+
+					if depth < config.CrawlDepth {
+						nextMu.Lock()
+						next = append(next, links...)
+						nextMu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, pageURL := range frontier {
+			jobs <- pageURL
+		}
+		close(jobs)
+		wg.Wait()
+
+		frontier = nil
+		for _, link := range next {
+			if visited[link] || (config.SameOrigin && !isSameOrigin(seedURL, link)) {
+				continue
+			}
+			visited[link] = true
+			frontier = append(frontier, link)
+		}
+	}
+
+	return nil
+}
+
+// crawlBrowsers hands out the browser each crawled page runs in: one shared
+// browser, or with --proxy-list one browser per proxy, assigned round-robin.
+// Chromium can't switch proxies at runtime, so every proxy gets its own
+// process and profile, launched on first use
+type crawlBrowsers struct {
+	config  Config
+	seed    string
+	proxies []string
+
+	// starting serializes launches of the same browser only, so workers
+	// waiting on different proxies start them in parallel
+	starting []sync.Mutex
+
+	mu       sync.Mutex
+	next     int
+	ctxs     []context.Context
+	cancels  []context.CancelFunc
+	releases []func()
+}
+
+func newCrawlBrowsers(config Config, seed string) *crawlBrowsers {
+	proxies := config.ProxyList
+	if len(proxies) == 0 {
+		proxies = []string{""}
+	}
+	return &crawlBrowsers{
+		config:   config,
+		seed:     seed,
+		proxies:  proxies,
+		starting: make([]sync.Mutex, len(proxies)),
+		ctxs:     make([]context.Context, len(proxies)),
+	}
+}
+
+// get returns the next browser in rotation and the proxy it uses
+func (b *crawlBrowsers) get() (context.Context, string, error) {
+	b.mu.Lock()
+	i := b.next % len(b.proxies)
+	b.next++
+	b.mu.Unlock()
+
+	browserCtx, err := b.browser(i)
+	return browserCtx, b.proxies[i], err
+}
+
+// browser returns the i-th browser, launching it on first use. The first
+// runs in the --max-browsers slot main already holds; every further proxy
+// browser takes a slot of its own
+func (b *crawlBrowsers) browser(i int) (context.Context, error) {
+	b.starting[i].Lock()
+	defer b.starting[i].Unlock()
+
+	b.mu.Lock()
+	browserCtx := b.ctxs[i]
+	b.mu.Unlock()
+	if browserCtx != nil {
+		return browserCtx, nil
+	}
+
+	config := b.config
+	if proxy := b.proxies[i]; proxy != "" {
+		// Two browsers can't share a profile directory
+		config.Proxy = proxy
+		config.Profile = fmt.Sprintf("%s-proxy-%d", b.config.Profile, i+1)
+	}
+	release := func() {}
+	if i > 0 && config.MaxBrowsers > 0 {
+		var err error
+		release, err = acquireBrowserSlot(config.MaxBrowsers)
+		if err != nil {
+			return nil, fmt.Errorf("could not acquire browser slot: %v", err)
+		}
+	}
+	browserCtx, cancel, allocCancel, err := openBrowser(config, b.seed)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// Start the browser without a timeout so per-page timeouts only ever
+	// close their own tab, not the whole browser
+	if err := chromedp.Run(browserCtx); err != nil {
+		if config.Session == "" {
+			cancel()
+			allocCancel()
+		}
+		release()
+		return nil, fmt.Errorf("could not start browser: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ctxs[i] = browserCtx
+	if config.Session == "" {
+		b.cancels = append(b.cancels, cancel, allocCancel)
+	}
+	b.releases = append(b.releases, release)
+	return browserCtx, nil
+}
+
+// close shuts down every browser that was launched and frees their
+// --max-browsers slots; session browsers are left running
+func (b *crawlBrowsers) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, cancel := range b.cancels {
+		cancel()
+	}
+	for _, release := range b.releases {
+		release()
+	}
+}
+
+// parseProxyList reads --proxy-list: a file with one proxy per line (blank
+// lines and # comments skipped), or a comma-separated list
+func parseProxyList(value string) ([]string, error) {
+	var entries []string
+	if data, err := os.ReadFile(value); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	} else {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no proxies in %q", value)
+	}
+	for _, entry := range entries {
+		if err := validateProxy(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// validateProxy checks a proxy is host:port or an http, https or socks5 URL
+// without credentials, which Chromium's --proxy-server ignores
+func validateProxy(proxy string) error {
+	if strings.Contains(proxy, "@") {
+		return fmt.Errorf("proxy %q has credentials, which Chromium's --proxy-server ignores; pass them with --proxy-auth user:pass", proxy)
+	}
+	if scheme, _, ok := strings.Cut(proxy, "://"); ok {
+		switch scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("proxy %q has an unsupported scheme (use http://, https:// or socks5://)", proxy)
+		}
+	}
+	return nil
+}
+
+// crawlPage processes a single crawled URL in its own tab and returns the
+// formatted result together with the links found on the final page
+func crawlPage(browserCtx context.Context, config Config, pageURL string, isSeed bool) (string, []string, error) {
+	tabCtx, cancel := chromedp.NewContext(browserCtx)
+	defer cancel()
+	if err := chromedp.Run(tabCtx); err != nil {
+		return "", nil, fmt.Errorf("could not open tab: %v", err)
+	}
+
+	ctx, timeoutCancel := context.WithTimeout(tabCtx, time.Duration(config.Timeout)*time.Second)
+	defer timeoutCancel()
+
+	// Form filling, after-submit navigation, screenshots, the console
+	// sidecar, download and manual waits only make sense for the seed page; --js
+	// still runs on every page
+	pageConfig := config
+	if !isSeed {
+		pageConfig.FormID = ""
+		pageConfig.Inputs = nil
+		pageConfig.AfterSubmitURL = ""
+		pageConfig.ScreenshotPath = ""
+		pageConfig.ConsoleOutputPath = ""
+		pageConfig.WaitForDownload = false
+		pageConfig.WaitForManual = ""
+	}
+	// Crawled tabs share one browser, so there is nothing to relaunch with
+	// another user agent or headful
+	pageConfig.FallbackHeadful = false
+	pageConfig.RetryUserAgents = nil
+
+	result, _, err := processPage(ctx, pageConfig, pageURL)
+	var failure *checkFailure
+	if errors.As(err, &failure) {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %v\n", pageURL, failure)
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	links, err := extractLinks(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not extract links from %s: %v\n", pageURL, err)
+	}
+	return result, links, nil
+}
+
+// extractLinks returns the absolute http(s) URLs of all anchors on the page,
+// without fragments and de-duplicated in document order
+func extractLinks(ctx context.Context) ([]string, error) {
+	var hrefs []string
+	err := chromedp.Run(ctx, chromedp.Evaluate(`Array.from(document.querySelectorAll('a[href]'), a => a.href)`, &hrefs))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var links []string
+	for _, href := range hrefs {
+		u, err := url.Parse(href)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		u.Fragment = ""
+		link := u.String()
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+// linkLines lists links one per line, noting how many --max-links left out
+func linkLines(links []string, more int) []string {
+	if len(links) == 0 {
+		return []string{"(none)"}
+	}
+	lines := append([]string(nil), links...)
+	if more > 0 {
+		lines = append(lines, fmt.Sprintf("... and %d more (raise --max-links to see them)", more))
+	}
+	return lines
+}
+
+// STORAGE_JS copies both Web Storage areas of the page. Merely reading
+// window.localStorage can throw, e.g. on opaque origins or when storage is
+// disabled, so each area is looked up inside the try
+const STORAGE_JS = `(() => {
+    const copy = (getArea) => {
+        try {
+            const area = getArea();
+            const items = {};
+            for (let i = 0; i < area.length; i++) {
+                const key = area.key(i);
+                items[key] = area.getItem(key);
+            }
+            return items;
+        } catch (e) {
+            return {};
+        }
+    };
+    return { local: copy(() => window.localStorage), session: copy(() => window.sessionStorage) };
+})()`
+
+// PageStorage is the page's localStorage and sessionStorage, as listed by
+// --dump-storage
+type PageStorage struct {
+	Local   map[string]string `json:"local"`
+	Session map[string]string `json:"session"`
+}
+
+// readStorage reads the page's localStorage and sessionStorage
+func readStorage(ctx context.Context) (*PageStorage, error) {
+	var storage PageStorage
+	if err := chromedp.Run(ctx, chromedp.Evaluate(STORAGE_JS, &storage)); err != nil {
+		return nil, err
+	}
+	return &storage, nil
+}
+
+// lines lists each storage area's items sorted by key
+func (s *PageStorage) lines() []string {
+	var lines []string
+	for _, area := range []struct {
+		name  string
+		items map[string]string
+	}{{"localStorage", s.Local}, {"sessionStorage", s.Session}} {
+		lines = append(lines, fmt.Sprintf("%s (%d):", area.name, len(area.items)))
+		keys := make([]string, 0, len(area.items))
+		for key := range area.items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("  %s = %s", key, area.items[key]))
+		}
+	}
+	return lines
+}
+
+// connectSession attaches to the tab of a running session browser
+func connectSession(sessionInfo *SessionInfo) (context.Context, context.CancelFunc, context.CancelFunc) {
+	// Connect to the browser via websocket
+	allocCtx, allocCancel := chromedp.NewRemoteAllocator(context.Background(), sessionInfo.WSURL)
+
+	// Attach to existing tab (we always have a target ID now)
+	ctx, cancel := chromedp.NewContext(allocCtx,
+		chromedp.WithTargetID(target.ID(sessionInfo.TargetID)))
+	return ctx, cancel, allocCancel
+}
+
+// sessionLaunchOnlyFlags lists the given flags that only apply when a
+// browser starts and differ from how the running session was started
+func sessionLaunchOnlyFlags(config Config, info *SessionInfo) []string {
+	var flags []string
+	if config.Headful && !info.Headful {
+		flags = append(flags, "--headful")
+	}
+	if config.LegacyHeadless && !info.LegacyHeadless {
+		flags = append(flags, "--legacy-headless")
+	}
+	if config.UBlock && !info.UBlock {
+		flags = append(flags, "--ublock")
+	}
+	if config.Proxy != "" && config.Proxy != info.Proxy {
+		flags = append(flags, "--proxy")
+	}
+	if config.Profile != "default" && config.Profile != info.Profile {
+		flags = append(flags, "--profile")
+	}
+	return flags
+}
+
+// localeRe matches the language-REGION tags --locale accepts
+var localeRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+// acceptLanguage builds an Accept-Language value preferring the full
+// locale, then its language, e.g. "de-DE,de;q=0.9"
+func acceptLanguage(locale string) string {
+	language, _, found := strings.Cut(locale, "-")
+	if !found {
+		return locale
+	}
+	return locale + "," + language + ";q=0.9"
+}
+
+// languageList returns the language tags of an Accept-Language value in
+// order, without their q-weights, e.g. "fr-FR,fr;q=0.9" gives [fr-FR fr]
+func languageList(acceptLanguage string) []string {
+	var languages []string
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" {
+			languages = append(languages, tag)
+		}
+	}
+	return languages
+}
+
+// pageLanguages is the Accept-Language value the run presents, from
+// --accept-language or else --locale; empty keeps the browser's own
+func pageLanguages(config Config) string {
+	if config.AcceptLanguage != "" {
+		return config.AcceptLanguage
+	}
+	if config.Locale != "" {
+		return acceptLanguage(config.Locale)
+	}
+	return ""
+}
+
+// stealthScript returns STEALTH_JS with navigator.languages matching the
+// Accept-Language the run sends, so the two don't contradict each other
+func stealthScript(acceptLanguage string) string {
+	languages := languageList(acceptLanguage)
+	if len(languages) == 0 {
+		return STEALTH_JS
+	}
+	list, _ := json.Marshal(languages)
+	return strings.Replace(STEALTH_JS, "get: () => ['en-US', 'en'],", "get: () => "+string(list)+",", 1)
+}
+
+// localeTimezone picks the timezone for a run: --timezone if given,
+// otherwise the --locale's default from LOCALE_TIMEZONES
+func localeTimezone(config Config) string {
+	if config.Timezone != "" {
+		return config.Timezone
+	}
+	return LOCALE_TIMEZONES[config.Locale]
+}
+
+// applyLocale sets navigator.language(s), Accept-Language, the Intl locale
+// and the timezone for the tab. The user agent override that carries the
+// language keeps --user-agent or --stealth's agent, or else Chromium's own.
+// An Accept-Language --header still wins for requests
+func applyLocale(ctx context.Context, config Config) error {
+	return chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		if config.Locale != "" {
+			userAgent := config.UserAgent
+			if userAgent == "" && config.Stealth {
+				userAgent = STEALTH_USER_AGENT
+			}
+			if userAgent == "" {
+				_, _, _, agent, _, err := browser.GetVersion().Do(ctx)
+				if err != nil {
+					return err
+				}
+				userAgent = agent
+			}
+			if err := emulation.SetUserAgentOverride(userAgent).WithAcceptLanguage(acceptLanguage(config.Locale)).Do(ctx); err != nil {
+				return err
+			}
+			// The Intl override takes ICU-style locales, e.g. de_DE
+			if err := emulation.SetLocaleOverride().WithLocale(strings.ReplaceAll(config.Locale, "-", "_")).Do(ctx); err != nil {
+				return err
+			}
+		}
+
+		timezone := localeTimezone(config)
+		if timezone == "" {
+			fmt.Fprintf(os.Stderr, "Warning: No default timezone for locale %s; set one with --timezone\n", config.Locale)
+			return nil
+		}
+		return emulation.SetTimezoneOverride(timezone).Do(ctx)
+	}))
+}
+
+// applySessionOverrides applies --stealth's or --user-agent's user agent and
+// --window-size to an existing session's tab. The user agent lasts for this
+// run; the window keeps its new size
+func applySessionOverrides(ctx context.Context, config Config) error {
+	userAgent := config.UserAgent
+	if userAgent == "" && config.Stealth {
+		userAgent = STEALTH_USER_AGENT
+	}
+	if userAgent != "" {
+		if err := chromedp.Run(ctx, emulation.SetUserAgentOverride(userAgent)); err != nil {
+			return fmt.Errorf("user agent: %v", err)
+		}
+	}
+
+	if config.WindowSize != "" {
+		width, height := parseWindowSize(config.WindowSize)
+		err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+			windowID, _, err := browser.GetWindowForTarget().Do(ctx)
+			if err != nil {
+				return err
+			}
+			return browser.SetWindowBounds(windowID, &browser.Bounds{
+				Width:       int64(width),
+				Height:      int64(height),
+				WindowState: browser.WindowStateNormal,
+			}).Do(ctx)
+		}))
+		if err != nil {
+			return fmt.Errorf("window size: %v", err)
+		}
+	}
+	return nil
+}
+
+// openBrowser connects to a persistent session or launches a one-shot browser
+// and returns a tab context along with its cancel and allocator cancel funcs
+func openBrowser(config Config, baseURL string) (context.Context, context.CancelFunc, context.CancelFunc, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var allocCancel context.CancelFunc
+	var sessionInfo *SessionInfo
+	reused := false
+
+	if config.Session != "" {
+		// Session mode: connect to existing or start new browser
+		existingSession, err := loadLiveSession(config.Session)
+		var busy *sessionNotResponding
+		if errors.As(err, &busy) {
+			return nil, nil, nil, err
+		}
+		if err == nil {
+			reused = true
+			// Connect to existing session
+			sessionInfo = existingSession
+			fmt.Fprintf(os.Stderr, "Connecting to session '%s'...\n", config.Session)
+
+			// Attach to a different tab for this run only; the session
+			// keeps its default tab
+			if config.TabTitle != "" {
+				targetID, err := findTabByTitle(sessionInfo.WSURL, config.TabTitle)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				tabInfo := *sessionInfo
+				tabInfo.TargetID = targetID
+				sessionInfo = &tabInfo
+			}
+		} else if config.TabTitle != "" {
+			return nil, nil, nil, fmt.Errorf("--tab-title needs a running session, but session '%s' does not exist", config.Session)
+		} else {
+			// Start new session browser with the initial URL
+			fmt.Fprintf(os.Stderr, "Starting new session '%s'...\n", config.Session)
+			sessionInfo, err = startSessionBrowser(config, baseURL)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			// Save the new session immediately
+			if err := saveSession(config.Session, *sessionInfo); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to save session: %v", err)
+			}
+		}
+
+		ctx, cancel, allocCancel = connectSession(sessionInfo)
+
+		// The browser was launched by an earlier run, so launch flags
+		// given now only take effect where CDP can apply them to the tab
+		if reused {
+			for _, flag := range sessionLaunchOnlyFlags(config, sessionInfo) {
+				fmt.Fprintf(os.Stderr, "Warning: %s has no effect on the running session '%s'; stop it and start a new one to change it\n", flag, config.Session)
+			}
+			if err := applySessionOverrides(ctx, config); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not apply settings to session '%s': %v\n", config.Session, err)
+			}
+		}
+	} else {
+		// One-shot mode: start fresh browser that will be closed
+		chromiumExec := getChromiumExec(config.ChromiumVersion)
+		chromiumDir := getChromiumDir()
+		profileDir := filepath.Join(chromiumDir, "profiles", config.Profile)
+		os.MkdirAll(profileDir, 0755)
+
+		var headless interface{} = headlessMode(config)
+		if config.Headful {
+			headless = false
+		}
+
+		opts := append(chromedp.DefaultExecAllocatorOptions[:],
+			chromedp.ExecPath(chromiumExec),
+			chromedp.UserDataDir(profileDir),
+			chromedp.Flag("headless", headless),
+			chromedp.Flag("disable-gpu", true),
+			chromedp.Flag("no-sandbox", true),
+			chromedp.Flag("disable-dev-shm-usage", true),
+			chromedp.Flag("disable-backgrounding-occluded-windows", true),
+			chromedp.Flag("disable-renderer-backgrounding", true),
+			chromedp.Flag("disable-component-extensions-with-background-pages", true),
+			chromedp.Flag("disable-default-apps", true),
+		)
+
+		// Only disable extensions if uBlock is not requested
+		if !config.UBlock {
+			opts = append(opts, chromedp.Flag("disable-extensions", true))
+		} else {
+			opts = append(opts, chromedp.Flag("load-extension", getUBlockDir()))
+		}
+
+		// Add stealth options if enabled
+		if config.Stealth {
+			opts = append(opts,
+				chromedp.Flag("disable-blink-features", "AutomationControlled"),
+				chromedp.UserAgent(STEALTH_USER_AGENT),
+			)
+		}
+
+		// --user-agent, or one picked by --retry-user-agents or --human,
+		// wins over stealth's
+		if config.UserAgent != "" {
+			opts = append(opts, chromedp.UserAgent(config.UserAgent))
+		}
+
+		if config.WindowSize != "" {
+			opts = append(opts, chromedp.WindowSize(parseWindowSize(config.WindowSize)))
+		}
+
+		if config.Proxy != "" {
+			opts = append(opts, chromedp.ProxyServer(config.Proxy))
+		}
+
+		allocCtx, allocCancelFunc := chromedp.NewExecAllocator(context.Background(), opts...)
+		allocCancel = allocCancelFunc
+
+		ctx, cancel = chromedp.NewContext(allocCtx)
+	}
+
+	return ctx, cancel, allocCancel, nil
+}
+
+// processPage runs the per-page pipeline (navigation, forms, JS, screenshot,
+// conversion) in the tab behind ctx and returns the formatted result, along
+// with the final URL and status of the page it ended up on
+func processPage(ctx context.Context, config Config, baseURL string) (string, PageMeta, error) {
+	var meta PageMeta
+	var headerRules []headerRule
+	for _, spec := range config.HeaderFor {
+		rule, err := parseHeaderFor(spec)
+		if err != nil {
+			return "", meta, err
+		}
+		headerRules = append(headerRules, rule)
+	}
+	blockedTypes, blockErr := parseResourceTypes(config.BlockResources)
+	if blockErr != nil {
+		return "", meta, blockErr
+	}
+
+	// Console message capture
+	var consoleMessages []ConsoleMessage
+	var exceptionCount int
+	var consoleMu sync.Mutex
+
+	var downloads *downloadTracker
+	if config.DownloadDir != "" {
+		downloads = newDownloadTracker()
+	}
+
+	// HTTP status of the last document response per frame, guarded by consoleMu
+	documentStatus := make(map[cdp.FrameID]int64)
+
+	// Requests already answered with --proxy-auth, guarded by consoleMu
+	proxyAuthTried := make(map[fetch.RequestID]bool)
+
+	// Requests for --requests, guarded by consoleMu too
+	var requests *requestLog
+	if config.Requests {
+		requests = newRequestLog()
+	}
+
+	// Network trace for --har, guarded by consoleMu too
+	var harRecorder *harLog
+	if config.HARPath != "" {
+		harRecorder = newHARLog()
+		defer func() {
+			var title string
+			chromedp.Run(ctx, chromedp.Title(&title))
+			consoleMu.Lock()
+			har := harRecorder.har(title)
+			consoleMu.Unlock()
+			if err := writeHAR(config.HARPath, har); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not write HAR file: %v\n", err)
+			}
+		}()
+	}
+
+	// URL and title changes for --trace-navigation, guarded by consoleMu too
+	var navigation *navTrace
+	if config.TraceNavigation {
+		navigation = &navTrace{}
+	}
+
+	// In-flight requests for --wait-network-idle
+	var idle *networkIdle
+	if config.WaitNetworkIdle {
+		idle = newNetworkIdle()
+	}
+
+	// Security findings for --security-report, guarded by consoleMu too
+	var securityReport *SecurityReport
+	if config.SecurityReport {
+		securityReport = &SecurityReport{}
+	}
+
+	// Write the JSON sidecar on every exit path, failed runs included
+	if config.ConsoleOutputPath != "" {
+		defer func() {
+			consoleMu.Lock()
+			defer consoleMu.Unlock()
+			if err := writeConsoleOutput(config.ConsoleOutputPath, consoleMessages); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not write console output: %v\n", err)
+			}
+		}()
+	}
+
+	// Listen for console events
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if requests != nil {
+			consoleMu.Lock()
+			requests.record(ev)
+			consoleMu.Unlock()
+		}
+		if harRecorder != nil {
+			consoleMu.Lock()
+			harRecorder.record(ev)
+			consoleMu.Unlock()
+		}
+		if securityReport != nil {
+			consoleMu.Lock()
+			securityReport.record(ev)
+			consoleMu.Unlock()
+		}
+		if navigation != nil {
+			consoleMu.Lock()
+			navigation.record(ev)
+			consoleMu.Unlock()
+		}
+		if downloads != nil {
+			downloads.record(ev)
+		}
+		if idle != nil {
+			idle.record(ev)
+		}
+
+		switch ev := ev.(type) {
+		case *network.EventResponseReceived:
+			if ev.Type == network.ResourceTypeDocument && ev.Response != nil {
+				consoleMu.Lock()
+				documentStatus[ev.FrameID] = ev.Response.Status
+				consoleMu.Unlock()
+			}
+
+		case *cdpruntime.EventConsoleAPICalled:
+			consoleMu.Lock()
+			defer consoleMu.Unlock()
+
+			level := strings.ToUpper(string(ev.Type))
+			if level == "LOG" {
+				level = "LOG"
+			} else if level == "WARNING" {
+				level = "WARNING"
+			} else if level == "ERROR" {
+				level = "ERROR"
+			}
+
+			var msgParts []string
+			for _, arg := range ev.Args {
+				val := ""
+				if arg.Value != nil {
+					// Properly unmarshal JSON value
+					var strVal string
+					if err := json.Unmarshal(arg.Value, &strVal); err == nil {
+						val = strVal
+					} else {
+						// Fallback: try as raw value (numbers, booleans, etc.)
+						val = strings.Trim(string(arg.Value), "\"")
+					}
+				} else if arg.Description != "" {
+					val = arg.Description
+				}
+				if val != "" {
+					msgParts = append(msgParts, val)
+				}
+			}
+			if len(msgParts) > 0 {
+				consoleMessages = append(consoleMessages, ConsoleMessage{
+					Level:     level,
+					Text:      strings.Join(msgParts, " "),
+					Timestamp: eventTime(ev.Timestamp),
+					Source:    stackSource(ev.StackTrace),
+				})
+			}
+
+		case *cdpruntime.EventExceptionThrown:
+			consoleMu.Lock()
+			defer consoleMu.Unlock()
+			if ev.ExceptionDetails != nil {
+				exceptionCount++
+				msg := ev.ExceptionDetails.Text
+				if ev.ExceptionDetails.Exception != nil && ev.ExceptionDetails.Exception.Description != "" {
+					msg = ev.ExceptionDetails.Exception.Description
+				}
+				source := stackSource(ev.ExceptionDetails.StackTrace)
+				if source == "" && ev.ExceptionDetails.URL != "" {
+					source = fmt.Sprintf("%s:%d:%d", ev.ExceptionDetails.URL, ev.ExceptionDetails.LineNumber+1, ev.ExceptionDetails.ColumnNumber+1)
+				}
+				consoleMessages = append(consoleMessages, ConsoleMessage{
+					Level:     "ERROR",
+					Text:      msg,
+					Timestamp: eventTime(ev.Timestamp),
+					Source:    source,
+				})
+			}
+
+		case *page.EventJavascriptDialogOpening:
+			consoleMu.Lock()
+			defer consoleMu.Unlock()
+			consoleMessages = append(consoleMessages, ConsoleMessage{
+				Level:     "DIALOG",
+				Text:      fmt.Sprintf("%s: %s", ev.Type, ev.Message),
+				Timestamp: time.Now(),
+				Source:    ev.URL,
+			})
+
+			// Respond to the dialog so it can't block the page; this must run
+			// outside the listener since it issues a CDP command
+			accept := config.Dialog == "accept"
+			go func() {
+				if err := chromedp.Run(ctx, page.HandleJavaScriptDialog(accept)); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not handle %s dialog: %v\n", ev.Type, err)
+				}
+			}()
+
+		case *fetch.EventAuthRequired:
+			// Answer the proxy's challenge once; a second challenge for the
+			// same request means the credentials were rejected
+			response := &fetch.AuthChallengeResponse{Response: fetch.AuthChallengeResponseResponseDefault}
+			if ev.AuthChallenge != nil && ev.AuthChallenge.Source == fetch.AuthChallengeSourceProxy {
+				consoleMu.Lock()
+				retried := proxyAuthTried[ev.RequestID]
+				proxyAuthTried[ev.RequestID] = true
+				consoleMu.Unlock()
+				if retried {
+					response.Response = fetch.AuthChallengeResponseResponseCancelAuth
+					fmt.Fprintf(os.Stderr, "Warning: Proxy rejected the --proxy-auth credentials\n")
+				} else {
+					response.Response = fetch.AuthChallengeResponseResponseProvideCredentials
+					response.Username, response.Password, _ = strings.Cut(config.ProxyAuth, ":")
+				}
+			}
+			go func() {
+				if err := chromedp.Run(ctx, fetch.ContinueWithAuth(ev.RequestID, response)); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not answer proxy authentication: %v\n", err)
+				}
+			}()
+
+		case *fetch.EventRequestPaused:
+			// Only requests matching a --header-for pattern or a
+			// --block-resources type (or all of them with --proxy-auth) are
+			// paused; every one must be continued or failed or the page hangs
+			if blockedTypes[ev.ResourceType] {
+				go func() {
+					if err := chromedp.Run(ctx, fetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient)); err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: Could not block request %s: %v\n", ev.Request.URL, err)
+					}
+				}()
+				return
+			}
+			continueReq := fetch.ContinueRequest(ev.RequestID)
+			if headers := applyHeaderRules(headerRules, ev.Request.URL, ev.Request.Headers); headers != nil {
+				continueReq = continueReq.WithHeaders(headers)
+			}
+			go func() {
+				if err := chromedp.Run(ctx, continueReq); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not continue request %s: %v\n", ev.Request.URL, err)
+				}
+			}()
+		}
+	})
+
+	// Security events are only sent once the domain is enabled
+	if securityReport != nil {
+		if err := chromedp.Run(ctx, security.Enable()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not enable security events: %v\n", err)
+		}
+	}
+
+	// Save downloads to --download-dir and report their progress
+	if downloads != nil {
+		dir, err := filepath.Abs(config.DownloadDir)
+		if err == nil {
+			err = os.MkdirAll(dir, 0755)
+		}
+		if err != nil {
+			return "", meta, fmt.Errorf("invalid download directory: %v", err)
+		}
+		err = chromedp.Run(ctx, browser.SetDownloadBehavior(browser.SetDownloadBehaviorBehaviorAllow).
+			WithDownloadPath(dir).
+			WithEventsEnabled(true))
+		if err != nil {
+			return "", meta, fmt.Errorf("could not set download directory: %v", err)
+		}
+	}
+
+	// Pause requests that need per-URL headers or are to be blocked. Proxy
+	// challenges are only raised for paused requests, so --proxy-auth pauses
+	// all of them
+	if len(headerRules) > 0 || len(blockedTypes) > 0 || config.ProxyAuth != "" {
+		var patterns []*fetch.RequestPattern
+		if config.ProxyAuth != "" {
+			patterns = append(patterns, &fetch.RequestPattern{URLPattern: "*"})
+		} else {
+			for _, rule := range headerRules {
+				patterns = append(patterns, &fetch.RequestPattern{URLPattern: rule.pattern})
+			}
+			for resourceType := range blockedTypes {
+				patterns = append(patterns, &fetch.RequestPattern{URLPattern: "*", ResourceType: resourceType})
+			}
+		}
+		enable := fetch.Enable().WithPatterns(patterns).WithHandleAuthRequests(config.ProxyAuth != "")
+		if err := chromedp.Run(ctx, enable); err != nil {
+			return "", meta, fmt.Errorf("could not enable request interception: %v", err)
+		}
+	}
+
+	// Inject stealth JS before navigation if enabled (runs before any page scripts)
+	if config.Stealth {
+		err := chromedp.Run(ctx, addInitScript(stealthScript(pageLanguages(config))))
+		if err != nil {
+			// Non-fatal, log and continue
+			fmt.Fprintf(os.Stderr, "Warning: Could not inject stealth script: %v\n", err)
+		}
+	}
+
+	// Register user setup scripts in the order given, also before page scripts
+	for i, script := range config.InitScripts {
+		if err := chromedp.Run(ctx, addInitScript(script)); err != nil {
+			return "", meta, fmt.Errorf("could not register init script %d: %v", i+1, err)
+		}
+	}
+
+	// Report title changes, which have no CDP event, through a binding
+	if navigation != nil {
+		err := chromedp.Run(ctx,
+			cdpruntime.AddBinding(NAV_TRACE_BINDING),
+			addInitScript(NAV_TRACE_JS),
+		)
+		if err != nil {
+			return "", meta, fmt.Errorf("could not set up navigation tracing: %v", err)
+		}
+	}
+
+	// Override the layout viewport independently of the window size, and
+	// the device pixel ratio for --dpr
+	if config.Viewport != "" || config.DeviceScale != 0 {
+		if err := chromedp.Run(ctx, applyViewport(config)); err != nil {
+			return "", meta, fmt.Errorf("could not set viewport: %v", err)
+		}
+	}
+
+	// Render the dark theme of sites that follow prefers-color-scheme
+	if config.DarkMode {
+		dark := emulation.SetEmulatedMedia().WithFeatures([]*emulation.MediaFeature{{Name: "prefers-color-scheme", Value: "dark"}})
+		if err := chromedp.Run(ctx, dark); err != nil {
+			return "", meta, fmt.Errorf("could not emulate dark mode: %v", err)
+		}
+	}
+
+	// Match language, formatting and timezone to --locale
+	if config.Locale != "" || config.Timezone != "" {
+		if err := applyLocale(ctx, config); err != nil {
+			return "", meta, fmt.Errorf("could not set locale: %v", err)
+		}
+	}
+
+	// Send --accept-language and --header values with every request the
+	// page makes; an Accept-Language --header wins
+	if len(config.Headers) > 0 || config.AcceptLanguage != "" {
+		headers := network.Headers{}
+		if config.AcceptLanguage != "" {
+			headers["Accept-Language"] = config.AcceptLanguage
+		}
+		for _, spec := range config.Headers {
+			name, value, err := parseHeader(spec)
+			if err != nil {
+				return "", meta, err
+			}
+			headers[name] = value
+		}
+		if err := chromedp.Run(ctx, network.SetExtraHTTPHeaders(headers)); err != nil {
+			return "", meta, fmt.Errorf("could not set headers: %v", err)
+		}
+	}
+
+	// Set --cookie values for the target URL before the first request
+	if len(config.Cookies) > 0 {
+		cookieURL := baseURL
+		if cookieURL == "" {
+			chromedp.Run(ctx, chromedp.Location(&cookieURL))
+		}
+		for _, spec := range config.Cookies {
+			name, value, err := parseCookieSpec(spec)
+			if err != nil {
+				return "", meta, err
+			}
+			err = chromedp.Run(ctx, network.SetCookie(name, value).WithURL(cookieURL))
+			if err != nil {
+				return "", meta, fmt.Errorf("could not set cookie %s: %v", name, err)
+			}
+		}
+	}
+
+	// Restore cookies saved by --cookies-out, on any machine
+	if config.CookiesIn != "" {
+		cookies, err := readCookies(config.CookiesIn)
+		if err != nil {
+			return "", meta, fmt.Errorf("could not read --cookies-in: %v", err)
+		}
+		if err := chromedp.Run(ctx, network.SetCookies(cookieParams(cookies, time.Now()))); err != nil {
+			return "", meta, fmt.Errorf("could not set cookies from %s: %v", config.CookiesIn, err)
+		}
+	}
+
+	// Navigate to page (skip if no URL in session mode - just use current page)
+	var err error
+	if baseURL != "" {
+		err = withRetries(ctx, config.Retry, func() error {
+			err := chromedp.Run(ctx, chromedp.Navigate(baseURL))
+			if err != nil && downloads != nil && strings.Contains(err.Error(), "net::ERR_ABORTED") {
+				// A URL that serves a file aborts the navigation and downloads it
+				fmt.Fprintf(os.Stderr, "Navigation to %s started a download\n", baseURL)
+				err = nil
+			}
+			if err != nil {
+				return fmt.Errorf("could not navigate to %s: %v", baseURL, err)
+			}
+
+			// Wait for page to load
+			if err := chromedp.Run(ctx, chromedp.WaitReady("body")); err != nil {
+				return fmt.Errorf("page did not load: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", meta, err
+		}
+
+		// A hydration error can leave the page half-rendered; one reload
+		// usually fixes it
+		if config.RetryOnJSError {
+			time.Sleep(500 * time.Millisecond)
+			consoleMu.Lock()
+			exceptions := exceptionCount
+			consoleMu.Unlock()
+			if exceptions > 0 && pageLooksIncomplete(ctx) {
+				fmt.Fprintf(os.Stderr, "Page threw %d uncaught exception(s) and looks incomplete, reloading once...\n", exceptions)
+				err = chromedp.Run(ctx, chromedp.Reload(), chromedp.WaitReady("body"))
+				if err != nil {
+					return "", meta, fmt.Errorf("page did not load after reload: %v", err)
+				}
+			}
+		}
+	}
+
+	// localStorage belongs to an origin, which only exists once a document
+	// from it has loaded, so seed it now and reload for the app to read it
+	if len(config.LocalStorage) > 0 {
+		if err := seedLocalStorage(ctx, config.LocalStorage); err != nil {
+			return "", meta, err
+		}
+	}
+
+	// Let XHR/fetch content of JS-rendered pages finish loading, and with
+	// --wait-for-idle finish rendering too
+	if idle != nil && baseURL != "" {
+		quiet := time.Duration(config.NetworkIdleMS) * time.Millisecond
+		timeout := time.Duration(config.WaitTimeout) * time.Millisecond
+		var err error
+		if config.WaitForIdle {
+			err = waitForIdle(ctx, idle, quiet, timeout)
+		} else {
+			err = idle.wait(ctx, quiet, timeout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v, continuing\n", err)
+		}
+	}
+
+	// Switch to the page's canonical URL, if it names a different one. The
+	// chain is only reported when the page was actually switched
+	var canonicalChain, canonical []string
+	if config.FollowCanonical && baseURL != "" {
+		canonicalChain, err = followCanonical(ctx)
+		if err != nil {
+			return "", meta, err
+		}
+		if len(canonicalChain) > 1 {
+			canonical = canonicalChain
+		}
+	}
+
+	// Detect LiveView pages
+	var isLiveView bool
+	err = chromedp.Run(ctx, chromedp.Evaluate(`document.querySelector('[data-phx-session]') !== null`, &isLiveView))
+	if err != nil {
+		isLiveView = false
+	}
+
+	if isLiveView {
+		fmt.Fprintln(os.Stderr, "Detected Phoenix LiveView page, waiting for connection...")
+		// Wait for Phoenix LiveView to connect
+		err = waitForSelector(ctx, ".phx-connected", 10*time.Second)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not detect LiveView connection: %v\n", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "Phoenix LiveView connected")
+		}
+	}
+
+	// Let a person clear a CAPTCHA or login challenge in the window
+	if config.WaitForManual != "" {
+		if err := waitForManual(ctx, config.WaitForManual); err != nil {
+			return "", meta, err
+		}
+	}
+
+	// Wait for content rendered after load, e.g. by a SPA
+	if config.WaitFor != "" {
+		err = waitForSelector(ctx, config.WaitFor, time.Duration(config.WaitTimeout)*time.Millisecond)
+		if err != nil {
+			return "", meta, fmt.Errorf("element %q did not appear within %dms: %v", config.WaitFor, config.WaitTimeout, err)
+		}
+	}
+
+	// Handle form submission if specified
+	var formResult *FormResult
+	if config.FormID != "" && len(config.Inputs) > 0 {
+		formResult, err = handleForm(ctx, config, isLiveView)
+		if err != nil {
+			return "", meta, fmt.Errorf("error handling form: %v", err)
+		}
+	}
+
+	// Click elements in order, letting each click's navigation settle
+	for _, selector := range config.Clicks {
+		var currentURL string
+		chromedp.Run(ctx, chromedp.Location(&currentURL))
+
+		randomWait(config)
+
+		if err := clickElement(ctx, config, selector); err != nil {
+			return "", meta, err
+		}
+
+		waitAfterJS(ctx, isLiveView, currentURL)
+	}
+
+	// Execute JavaScript steps in order, letting each one's navigation settle
+	// before the next. Only the last step's return value is kept
+	var jsResult interface{}
+	for step, code := range config.JSCode {
+		// Store current URL before executing JS
+		var currentURL string
+		chromedp.Run(ctx, chromedp.Location(&currentURL))
+
+		randomWait(config)
+
+		jsCode := code
+		if config.JSScope != "" {
+			jsCode = scopedJS(config.JSScope, code)
+		}
+
+		jsResult = nil
+		err = chromedp.Run(ctx, chromedp.Evaluate(jsCode, &jsResult))
+		if err != nil {
+			if len(config.JSCode) > 1 {
+				fmt.Fprintf(os.Stderr, "Warning: JavaScript step %d of %d failed: %v\n", step+1, len(config.JSCode), err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: JavaScript execution failed: %v\n", err)
+			}
+		}
+
+		waitAfterJS(ctx, isLiveView, currentURL)
+	}
+
+	// Wait for whichever outcome the page shows, e.g. after a form submit
+	var matchedSelector string
+	if len(config.WaitForAny) > 0 {
+		matchedSelector, err = waitForAnySelector(ctx, config.WaitForAny, time.Duration(config.WaitTimeout)*time.Millisecond)
+		if err != nil {
+			return "", meta, err
+		}
+		fmt.Fprintf(os.Stderr, "Matched --wait-for-any selector: %s\n", matchedSelector)
+	}
+
+	// Scroll through the page so lazy-loaded images and feed items render
+	if config.Scroll {
+		if err := chromedp.Run(ctx, autoScroll(maxScrollSteps, scrollPause)); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not scroll the page: %v\n", err)
+		}
+	}
+
+	// Wait for a download triggered by the page, form or --js
+	var downloadPath string
+	if config.WaitForDownload {
+		fmt.Fprintln(os.Stderr, "Waiting for download to finish...")
+		downloadPath, err = downloads.wait(ctx, 10*time.Second)
+		if err != nil {
+			return "", meta, fmt.Errorf("--wait-for-download: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Download saved to %s\n", downloadPath)
+	}
+
+	// Take screenshot if requested
+	var screenshotDiff *ScreenshotDiff
+	if config.ScreenshotPath != "" {
+		// Capture the visible viewport unless the whole page was asked for
+		var screenshot []byte
+		if config.ScreenshotSelector != "" {
+			screenshot, err = elementScreenshot(ctx, config.ScreenshotSelector, config.ScreenshotPadding)
+		} else if config.ScreenshotStitch {
+			screenshot, err = stitchedScreenshot(ctx)
+		} else {
+			capture := chromedp.CaptureScreenshot(&screenshot)
+			if config.ScreenshotFullPage {
+				capture = chromedp.FullScreenshot(&screenshot, 100)
+			}
+			err = chromedp.Run(ctx, capture)
+		}
+		if err != nil {
+			return "", meta, fmt.Errorf("error taking screenshot: %v", err)
+		}
+		err = os.WriteFile(config.ScreenshotPath, screenshot, 0644)
+		if err != nil {
+			return "", meta, fmt.Errorf("error saving screenshot: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Screenshot saved to %s\n", config.ScreenshotPath)
+
+		if config.ScreenshotBaseline != "" {
+			screenshotDiff, err = compareScreenshot(screenshot, config.ScreenshotBaseline, diffImagePath(config.ScreenshotPath))
+			if err != nil {
+				return "", meta, fmt.Errorf("error comparing screenshot: %v", err)
+			}
+		}
+	}
+
+	// Export a PDF if requested
+	if config.PDFPath != "" {
+		pdf, err := printPDF(ctx, config)
+		if err != nil {
+			return "", meta, fmt.Errorf("error printing PDF: %v", err)
+		}
+		err = os.WriteFile(config.PDFPath, pdf, 0644)
+		if err != nil {
+			return "", meta, fmt.Errorf("error saving PDF: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "PDF saved to %s\n", config.PDFPath)
+	}
+	var diffFailure *checkFailure
+	if screenshotDiff != nil && screenshotDiff.Percent > config.ScreenshotThreshold {
+		diffFailure = &checkFailure{fmt.Sprintf("screenshot differs from baseline by %.2f%% (threshold %.2f%%)", screenshotDiff.Percent, config.ScreenshotThreshold)}
+	}
+
+	// Navigate to after-submit URL if provided
+	if config.AfterSubmitURL != "" {
+		var currentURL string
+		chromedp.Run(ctx, chromedp.Location(&currentURL))
+		afterSubmitURL := resolveAfterSubmitURL(config.AfterSubmitURL, currentURL)
+
+		fmt.Fprintf(os.Stderr, "Navigating to after-submit URL: %s\n", afterSubmitURL)
+		err = chromedp.Run(ctx, chromedp.Navigate(afterSubmitURL))
+		if err != nil {
+			return "", meta, fmt.Errorf("could not navigate to after-submit URL: %v", err)
+		}
+		chromedp.Run(ctx, chromedp.WaitReady("body"))
+	}
+
+	// Save every cookie, e.g. after logging in, for --cookies-in
+	if config.CookiesOut != "" {
+		cookies, err := getCookies(ctx)
+		if err != nil {
+			return "", meta, fmt.Errorf("could not read cookies: %v", err)
+		}
+		if err := writeCookies(config.CookiesOut, cookies); err != nil {
+			return "", meta, fmt.Errorf("could not save cookies: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Saved %d cookies to %s\n", len(cookies), config.CookiesOut)
+	}
+
+	// Every session run adds its console output to the tab's buffer, so
+	// --console-buffer can show what earlier runs logged
+	var consoleBuffer []ConsoleMessage
+	if config.Session != "" || config.SaveSession != "" {
+		if target := chromedp.FromContext(ctx).Target; target != nil {
+			consoleMu.Lock()
+			messages := append([]ConsoleMessage(nil), consoleMessages...)
+			consoleMu.Unlock()
+			buffer, err := appendConsoleBuffer(consoleBufferFile(string(target.TargetID)), messages, CONSOLE_BUFFER_SIZE)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not update the console buffer: %v\n", err)
+			} else if config.ConsoleBuffer {
+				consoleBuffer = buffer
+			}
+		}
+	}
+
+	// Find the main frame, whose document status the header, --fail-on-error
+	// and the security report use
+	var mainFrameID cdp.FrameID
+	chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		tree, err := page.GetFrameTree().Do(ctx)
+		if err != nil {
+			return err
+		}
+		mainFrameID = tree.Frame.ID
+		return nil
+	}))
+	consoleMu.Lock()
+	pageStatus := documentStatus[mainFrameID]
+	consoleMu.Unlock()
+	meta.Status = pageStatus
+	chromedp.Run(ctx, chromedp.Location(&meta.FinalURL))
+	// Error pages are still printed, but --fail-on-error exits with status 2,
+	// in the single-value modes below too
+	var statusFailure *checkFailure
+	if config.FailOnError && pageStatus >= 400 {
+		statusFailure = &checkFailure{"page returned " + strings.TrimPrefix(statusLine(pageStatus), "Status: ")}
+	}
+	withStatus := func(output string, err error) (string, PageMeta, error) {
+		if err == nil && statusFailure != nil {
+			err = statusFailure
+		}
+		return output, meta, err
+	}
+
+	// Print a single element's text instead of the whole page
+	if config.ElementText != "" {
+		return withStatus(elementText(ctx, config.ElementText))
+	}
+
+	// Print attribute values instead of the whole page
+	if len(config.Attributes) > 0 {
+		return withStatus(extractAttributes(ctx, config.Attributes))
+	}
+
+	// Print an attribute of every matching element instead of the whole page
+	if config.ExtractAttrSelector != "" {
+		return withStatus(extractAttributeAll(ctx, config.ExtractAttrSelector, config.ExtractAttrName, config.JSONOutput))
+	}
+
+	// Print the number of matching elements instead of the whole page
+	if config.CountSelector != "" {
+		return withStatus(countElements(ctx, config.CountSelector, config.FailOnZero))
+	}
+
+	// Print the page's images instead of the whole page
+	if config.ExtractImages {
+		return withStatus(extractImages(ctx))
+	}
+
+	// Get page content, or only that of the chosen iframe
+	var content string
+	if config.IFrame != "" {
+		content, err = iframeHTML(ctx, config.IFrame)
+		if err != nil {
+			return "", meta, err
+		}
+	} else if config.ShadowDOM {
+		content, err = shadowHTML(ctx, config.ShadowDepth)
+		if err != nil {
+			return "", meta, err
+		}
+	} else {
+		err = chromedp.Run(ctx, chromedp.OuterHTML("html", &content))
+		if err != nil {
+			return "", meta, fmt.Errorf("could not get page content: %v", err)
+		}
+	}
+
+	// Collect page complexity stats
+	var domStats *DOMStats
+	if config.DOMStats {
+		domStats = &DOMStats{}
+		if err := chromedp.Run(ctx, chromedp.Evaluate(DOM_STATS_JS, domStats)); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not collect DOM stats: %v\n", err)
+			domStats = nil
+		} else {
+			domStats.HTMLBytes = len(content)
+		}
+	}
+
+	// Keep only the parts of the page asked for
+	if len(config.Extract) > 0 {
+		content, err = extractElements(ctx, content, config.Extract)
+		if err != nil {
+			return "", meta, err
+		}
+	}
+
+	var navStates []NavState
+	if navigation != nil {
+		consoleMu.Lock()
+		navStates = append([]NavState(nil), navigation.states...)
+		consoleMu.Unlock()
+	}
+	var requestEntries []RequestEntry
+	if requests != nil {
+		consoleMu.Lock()
+		requestEntries = requests.sorted(config.RequestsSort)
+		consoleMu.Unlock()
+	}
+	// Outgoing links of the final page, up to --max-links
+	var pageLinks []string
+	moreLinks := 0
+	if config.Links {
+		pageLinks, err = extractLinks(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not extract links: %v\n", err)
+		}
+		if config.MaxLinks > 0 && len(pageLinks) > config.MaxLinks {
+			moreLinks = len(pageLinks) - config.MaxLinks
+			pageLinks = pageLinks[:config.MaxLinks]
+		}
+	}
+
+	// Client-side state, read once the page has settled
+	var pageStorage *PageStorage
+	if config.DumpStorage {
+		pageStorage, err = readStorage(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not read storage: %v\n", err)
+		}
+	}
+
+	// Events keep updating the report, so the output uses a copy
+	var security *SecurityReport
+	var securityLines []string
+	if securityReport != nil {
+		consoleMu.Lock()
+		securityReport.finish(string(mainFrameID))
+		report := *securityReport
+		consoleMu.Unlock()
+		security = &report
+		securityLines = security.lines()
+	}
+
+	// Convert HTML to markdown, linking images to local copies with --save-images
+	markdownHTML := content
+	if config.SaveImagesDir != "" {
+		markdownHTML, err = saveImages(ctx, config, content)
+		if err != nil {
+			return "", meta, fmt.Errorf("could not save images: %v", err)
+		}
+	}
+	text, err := html2text.FromString(markdownHTML)
+	if err != nil {
+		return "", meta, fmt.Errorf("could not convert HTML to text: %v", err)
+	}
+
+	// The first failed check exits with status 2
+	var pageFailure *checkFailure
+	switch {
+	case diffFailure != nil:
+		pageFailure = diffFailure
+	case statusFailure != nil:
+		pageFailure = statusFailure
+	case formResult != nil && formResult.LoginFailed:
+		pageFailure = &checkFailure{"login appears to have failed: " + strings.Join(formResult.FailureSignals, "; ")}
+	}
+
+	// Only one-shot runs can be retried when the page looks blocked
+	var blocked *blockedPage
+	if retriesOnBlock(config) {
+		if isBlocked, reason := detectBlockedPage(text); isBlocked {
+			blocked = &blockedPage{reason, pageFailure}
+		}
+	}
+
+	// Return raw HTML if requested
+	if config.RawFlag {
+		// Keep the HTML untouched and report stats on stderr instead
+		if domStats != nil {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("DOM STATS", domStats.lines()), "\n"))
+		}
+		if screenshotDiff != nil && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("SCREENSHOT DIFF", screenshotDiff.lines()), "\n"))
+		}
+		if securityLines != nil && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("SECURITY REPORT", securityLines), "\n"))
+		}
+		if len(canonicalChain) > 1 && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("CANONICAL", canonicalLines(canonicalChain)), "\n"))
+		}
+		if len(navStates) > 0 && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("NAVIGATION", navLines(navStates)), "\n"))
+		}
+		if requests != nil && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("REQUESTS", requestLines(requestEntries)), "\n"))
+		}
+		if config.Links && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("LINKS", linkLines(pageLinks, moreLinks)), "\n"))
+		}
+		if pageStorage != nil && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("STORAGE", pageStorage.lines()), "\n"))
+		}
+		if formResult != nil && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("FORM RESULT", formResult.lines()), "\n"))
+		}
+		if jsResult != nil && !config.JSONOutput && config.Template == "" {
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("JS RESULT", []string{formatJSResult(jsResult)}), "\n"))
+		}
+		if len(consoleBuffer) > 0 && !config.JSONOutput && config.Template == "" {
+			var lines []string
+			for _, m := range consoleBuffer {
+				lines = append(lines, m.String())
+			}
+			fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("CONSOLE OUTPUT", lines), "\n"))
+		}
+		output := content
+		if config.MinifyHTML {
+			output = minifyHTML(content, config.StripScripts)
+		}
+		var metrics *ContentMetrics
+		if config.ContentMetrics {
+			metrics = newContentMetrics(content, cleanMarkdown(text), output, false)
+			if !config.JSONOutput && config.Template == "" {
+				fmt.Fprint(os.Stderr, strings.TrimLeft(formatSection("CONTENT METRICS", metrics.lines()), "\n"))
+			}
+		}
+		if config.JSONOutput || config.Template != "" {
+			consoleMu.Lock()
+			messages := append([]ConsoleMessage(nil), consoleMessages...)
+			status := documentStatus[mainFrameID]
+			consoleMu.Unlock()
+			if consoleBuffer != nil {
+				messages = consoleBuffer
+			}
+			output, err = renderPageResult(ctx, config, baseURL, PageResult{Status: status, RawHTML: output, DOMStats: domStats, Metrics: metrics, Security: security, Screenshot: screenshotDiff, Canonical: canonical, Form: formResult, Download: downloadPath, JSResult: jsResult, Matched: matchedSelector, Navigation: navStates, Requests: requestEntries, Links: pageLinks, Storage: pageStorage}, messages)
+			if err != nil {
+				return "", meta, err
+			}
+		}
+		if blocked != nil {
+			return output, meta, blocked
+		}
+		if pageFailure != nil {
+			return output, meta, pageFailure
+		}
+		return output, meta, nil
+	}
+
+	// Clean and format the markdown
+	markdown := cleanMarkdown(text)
+
+	// JSON documents are printed indented instead of converted
+	isJSON := false
+	if config.PrettyPrintJSON {
+		if body, ok := jsonDocumentBody(ctx); ok {
+			if pretty, err := prettyJSON(body); err == nil {
+				markdown, isJSON = pretty, true
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: Could not parse JSON response, printing it as text: %v\n", err)
+			}
+		}
+	}
+	fullMarkdown := markdown
+
+	// Truncate if specified
+	truncated := false
+	if len(markdown) > config.TruncateAfter {
+		if isJSON {
+			// Cut at a line boundary and close open brackets so the JSON stays valid
+			markdown = truncateJSON(markdown, config.TruncateAfter) + fmt.Sprintf("\n\n... (JSON truncated after %d chars, full content was %d chars)", config.TruncateAfter, len(fullMarkdown))
+		} else {
+			markdown = cutAtRune(markdown, config.TruncateAfter) + fmt.Sprintf("\n\n... (output truncated after %d chars, full content was %d chars)", config.TruncateAfter, len(text))
+		}
+		truncated = true
+	}
+
+	// Structured output replaces the text layout below
+	if config.JSONOutput || config.Template != "" {
+		jsonMarkdown := fullMarkdown
+		if truncated {
+			jsonMarkdown = cutAtRune(fullMarkdown, config.TruncateAfter)
+			if isJSON {
+				jsonMarkdown = truncateJSON(fullMarkdown, config.TruncateAfter)
+			}
+		}
+		var metrics *ContentMetrics
+		if config.ContentMetrics {
+			metrics = newContentMetrics(content, fullMarkdown, jsonMarkdown, truncated)
+		}
+		consoleMu.Lock()
+		messages := append([]ConsoleMessage(nil), consoleMessages...)
+		status := documentStatus[mainFrameID]
+		consoleMu.Unlock()
+		if consoleBuffer != nil {
+			messages = consoleBuffer
+		}
+		result, err := renderPageResult(ctx, config, baseURL, PageResult{Status: status, Markdown: jsonMarkdown, Truncated: truncated, DOMStats: domStats, Metrics: metrics, Security: security, Screenshot: screenshotDiff, Canonical: canonical, Form: formResult, Download: downloadPath, JSResult: jsResult, Matched: matchedSelector, Navigation: navStates, Requests: requestEntries, Links: pageLinks, Storage: pageStorage}, messages)
+		if err != nil {
+			return "", meta, err
+		}
+		if blocked != nil {
+			return result, meta, blocked
+		}
+		if pageFailure != nil {
+			return result, meta, pageFailure
+		}
+		return result, meta, nil
+	}
+
+	// Get current URL for the header (in case we didn't navigate, e.g. session
+	// with --js only), and the final one if redirects or scripts moved the page
+	var currentURL string
+	var details []string
+	chromedp.Run(ctx, chromedp.Location(&currentURL))
+	displayURL := baseURL
+	if displayURL == "" {
+		displayURL = currentURL
+	} else if !sameURL(displayURL, currentURL) {
+		details = append(details, "Final URL: "+currentURL)
+	}
+	// Only error statuses go in the header: a 2xx or 3xx page is the document
+	// that was asked for, so its header stays the plain URL as it always was.
+	// --json and --exec-after get the status of every page
+	if pageStatus >= 400 {
+		details = append(details, statusLine(pageStatus))
+	}
+
+	// Add header with URL and console messages
+	result := formatBanner(config.Banner, displayURL, details) + markdown
+
+	// Add DOM stats
+	if domStats != nil {
+		result += formatBannerSection(config.Banner, "DOM STATS", domStats.lines())
+	}
+
+	// Add content size metrics
+	if config.ContentMetrics {
+		result += formatBannerSection(config.Banner, "CONTENT METRICS", newContentMetrics(content, fullMarkdown, markdown, truncated).lines())
+	}
+
+	// Add finished download
+	if downloadPath != "" {
+		result += formatBannerSection(config.Banner, "DOWNLOAD", []string{"Saved: " + downloadPath})
+	}
+
+	// Add the canonical redirect
+	if len(canonicalChain) > 1 {
+		result += formatBannerSection(config.Banner, "CANONICAL", canonicalLines(canonicalChain))
+	}
+
+	// Add the sequence of pages the run went through
+	if len(navStates) > 0 {
+		result += formatBannerSection(config.Banner, "NAVIGATION", navLines(navStates))
+	}
+
+	// Add the request summary
+	if requests != nil {
+		result += formatBannerSection(config.Banner, "REQUESTS", requestLines(requestEntries))
+	}
+
+	// Add the page's outgoing links
+	if config.Links {
+		result += formatBannerSection(config.Banner, "LINKS", linkLines(pageLinks, moreLinks))
+	}
+
+	// Add the page's localStorage and sessionStorage
+	if pageStorage != nil {
+		result += formatBannerSection(config.Banner, "STORAGE", pageStorage.lines())
+	}
+
+	// Add security findings
+	if securityLines != nil {
+		result += formatBannerSection(config.Banner, "SECURITY REPORT", securityLines)
+	}
+
+	// Add screenshot comparison
+	if screenshotDiff != nil {
+		result += formatBannerSection(config.Banner, "SCREENSHOT DIFF", screenshotDiff.lines())
+	}
+
+	// Add the last --js step's return value
+	if jsResult != nil {
+		result += formatBannerSection(config.Banner, "JS RESULT", []string{formatJSResult(jsResult)})
+	}
+
+	// Add form submission outcome
+	if formResult != nil {
+		result += formatBannerSection(config.Banner, "FORM RESULT", formResult.lines())
+	}
+
+	// Add console messages if any, or the whole buffer with --console-buffer
+	consoleMu.Lock()
+	messages := consoleMessages
+	if consoleBuffer != nil {
+		messages = consoleBuffer
+	}
+	if len(messages) > 0 {
+		var lines []string
+		for _, m := range messages {
+			lines = append(lines, m.String())
+		}
+		result += formatBannerSection(config.Banner, "CONSOLE OUTPUT", lines)
+	}
+	consoleMu.Unlock()
+
+	if blocked != nil {
+		return result, meta, blocked
+	}
+	if pageFailure != nil {
+		return result, meta, pageFailure
+	}
+	return result, meta, nil
+}
+
+// seedLocalStorage sets the --local-storage items in the loaded page and
+// reloads it if any changed, since apps usually read storage on startup
+func seedLocalStorage(ctx context.Context, specs []string) error {
+	var items [][2]string
+	for _, spec := range specs {
+		key, value, err := parseStorageSpec(spec)
+		if err != nil {
+			return err
+		}
+		items = append(items, [2]string{key, value})
+	}
+	itemsJSON, _ := json.Marshal(items)
+
+	var changed bool
+	if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(LOCAL_STORAGE_JS, itemsJSON), &changed)); err != nil {
+		return fmt.Errorf("could not set localStorage: %v", err)
+	}
+	if !changed {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Set %d localStorage item(s), reloading...\n", len(items))
+	if err := chromedp.Run(ctx, chromedp.Reload(), chromedp.WaitReady("body")); err != nil {
+		return fmt.Errorf("page did not load after setting localStorage: %v", err)
+	}
+	return nil
+}
+
+// addInitScript registers JavaScript to run in every new document before any
+// of the page's own scripts
+func addInitScript(source string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		_, err := page.AddScriptToEvaluateOnNewDocument(source).Do(ctx)
+		return err
+	})
+}
+
+// randomWait sleeps for a random duration within the --wait-random range so
+// interaction steps don't happen with machine-regular timing
+func randomWait(config Config) {
+	if config.WaitRandomMax <= 0 {
+		return
+	}
+	delay := config.WaitRandomMin
+	if config.WaitRandomMax > config.WaitRandomMin {
+		delay += rand.Intn(config.WaitRandomMax - config.WaitRandomMin + 1)
+	}
+	time.Sleep(time.Duration(delay) * time.Millisecond)
+}
+
+// applyDevice sets the viewport, pixel ratio and user agent of device where
+// the command line left them unset
+func applyDevice(config *Config, device Device) {
+	if config.Viewport == "" {
+		config.Viewport = fmt.Sprintf("%dx%d", device.Width, device.Height)
+	}
+	if config.DeviceScale == 0 {
+		config.DeviceScale = device.Scale
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = device.UserAgent
+	}
+}
+
+// deviceNames lists the --emulate-device profiles alphabetically
+func deviceNames() []string {
+	names := make([]string, 0, len(DEVICES))
+	for name := range DEVICES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyHumanPreset turns on the settings --human bundles, leaving anything
+// set explicitly alone: --stealth, a random Chrome user agent from the retry
+// pool, --random-hardware, a common screen size, --wait-random 300,1200,
+// --input-delay 40,160 and --human-mouse
+func applyHumanPreset(config *Config) {
+	config.Stealth = true
+
+	if config.UserAgent == "" {
+		var chromeAgents []string
+		for _, ua := range RETRY_USER_AGENT_POOL {
+			// Other browsers' user agents would contradict Chromium's features
+			if strings.Contains(ua, "Chrome/") && !strings.Contains(ua, "Edg/") {
+				chromeAgents = append(chromeAgents, ua)
+			}
+		}
+		if len(chromeAgents) > 0 {
+			config.UserAgent = chromeAgents[rand.Intn(len(chromeAgents))]
+		}
+	}
+
+	config.RandomHardware = true
+
+	if config.WindowSize == "" && config.Viewport == "" {
+		size := HUMAN_VIEWPORTS[rand.Intn(len(HUMAN_VIEWPORTS))]
+		config.WindowSize = size
+		config.Viewport = size
+	}
+
+	if config.WaitRandomMax == 0 {
+		config.WaitRandomMin, config.WaitRandomMax = 300, 1200
+	}
+
+	if config.InputDelayMax == 0 {
+		config.InputDelayMin, config.InputDelayMax = 40, 160
+	}
+
+	config.HumanMouse = true
+}
+
+// randomHardwareScript returns RANDOM_HARDWARE_JS with a common core count
+// and memory size picked at random, for --random-hardware
+func randomHardwareScript() string {
+	cores := []int{4, 8, 12, 16}[rand.Intn(4)]
+	memory := []int{4, 8}[rand.Intn(2)]
+	return fmt.Sprintf(RANDOM_HARDWARE_JS, cores, memory)
+}
+
+// humanSendKeys types text one key at a time for --input-delay, pausing a
+// random minDelay-maxDelay milliseconds after each key
+func humanSendKeys(selector, text string, minDelay, maxDelay int) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		for _, r := range text {
+			if err := chromedp.SendKeys(selector, string(r)).Do(ctx); err != nil {
+				return err
+			}
+			time.Sleep(time.Duration(minDelay+rand.Intn(maxDelay-minDelay+1)) * time.Millisecond)
+		}
+		return nil
+	})
+}
+
+// humanMouseMove moves the pointer to a point inside the first element
+// matching selector in small steps, so the click that follows isn't the
+// pointer's first appearance on the page
+func humanMouseMove(selector string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var rect struct {
+			X      float64 `json:"x"`
+			Y      float64 `json:"y"`
+			Width  float64 `json:"width"`
+			Height float64 `json:"height"`
+		}
+		err := chromedp.Evaluate(fmt.Sprintf(
+			`(() => { const el = document.querySelector(%s); if (!el) return {}; el.scrollIntoView({block: 'center'}); const r = el.getBoundingClientRect(); return {x: r.x, y: r.y, width: r.width, height: r.height}; })()`,
+			jsString(selector),
+		), &rect).Do(ctx)
+		if err != nil || rect.Width == 0 {
+			return err
+		}
+
+		startX, startY := rand.Float64()*rect.X, rand.Float64()*rect.Y
+		endX := rect.X + rect.Width*(0.3+0.4*rand.Float64())
+		endY := rect.Y + rect.Height*(0.3+0.4*rand.Float64())
+		steps := 8 + rand.Intn(8)
+		for i := 1; i <= steps; i++ {
+			// Ease out so the pointer slows down near the target
+			t := float64(i) / float64(steps)
+			t = 1 - (1-t)*(1-t)
+			x := startX + (endX-startX)*t + rand.Float64()*2 - 1
+			y := startY + (endY-startY)*t + rand.Float64()*2 - 1
+			if err := input.DispatchMouseEvent(input.MouseMoved, x, y).Do(ctx); err != nil {
+				return err
+			}
+			time.Sleep(time.Duration(10+rand.Intn(25)) * time.Millisecond)
+		}
+		return nil
+	})
+}
+
+// applyViewport emulates the --viewport dimensions so media queries and
+// full-page screenshots use that layout width regardless of the window size.
+// Without --viewport the window's size is kept (0 disables the width and
+// height overrides) and only --dpr applies. --emulate-device also turns on
+// the mobile layout (meta viewport, overlay scrollbars) and touch events
+func applyViewport(config Config) chromedp.Action {
+	var width, height int
+	if config.Viewport != "" {
+		width, height = parseWindowSize(config.Viewport)
+	}
+	scale := config.DeviceScale
+	if scale == 0 {
+		scale = 1
+	}
+	mobile := config.EmulateDevice != ""
+	if !mobile {
+		return emulation.SetDeviceMetricsOverride(int64(width), int64(height), scale, false)
+	}
+	return chromedp.Tasks{
+		emulation.SetDeviceMetricsOverride(int64(width), int64(height), scale, true),
+		emulation.SetTouchEmulationEnabled(true).WithMaxTouchPoints(5),
+	}
+}
+
+// runAction runs an interaction step, retrying it up to config.ActionRetries
+// times after a short pause so transient failures (detached or re-rendered
+// nodes in dynamic UIs) don't abort the run
+func runAction(ctx context.Context, config Config, actions ...chromedp.Action) error {
+	err := chromedp.Run(ctx, actions...)
+	for attempt := 1; err != nil && attempt <= config.ActionRetries && ctx.Err() == nil; attempt++ {
+		fmt.Fprintf(os.Stderr, "Action failed (%v), retrying (%d/%d)...\n", err, attempt, config.ActionRetries)
+		time.Sleep(500 * time.Millisecond)
+		err = chromedp.Run(ctx, actions...)
+	}
+	return err
+}
+
+// withRetries runs fn, retrying a failure up to retries times with an
+// exponential backoff between attempts, as long as ctx has time left
+func withRetries(ctx context.Context, retries int, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		delay := retryBackoff(attempt)
+		fmt.Fprintf(os.Stderr, "%v; retrying in %s (%d/%d)...\n", err, delay, attempt, retries)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = fn()
+	}
+	return err
+}
+
+// retryBackoff is the wait before retry attempt n: 1s, doubling each time
+// up to 30s
+func retryBackoff(attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < 30*time.Second; i++ {
+		delay *= 2
+	}
+	if delay > 30*time.Second {
+		delay = 30 * time.Second
+	}
+	return delay
+}
+
+// detectLoginFailure flags a login as likely failed when error messages are
+// shown or a password field is still rendered after submitting
+func detectLoginFailure(ctx context.Context, formResult *FormResult) {
+	var passwordVisible bool
+	chromedp.Run(ctx, chromedp.Evaluate(
+		`Array.from(document.querySelectorAll('input[type="password"]')).some(el => el.offsetParent !== null)`,
+		&passwordVisible,
+	))
+	formResult.LoginFailed, formResult.FailureSignals = loginFailure(formResult.Navigated, passwordVisible, formResult.Errors)
+}
+
+// loginFailure weighs the signals left after a login submit. Error messages
+// or a password field still shown fail the login on their own. Staying on
+// the login URL is only advisory: single-page apps log in without
+// navigating, so it is listed as a signal but never fails the login alone
+func loginFailure(navigated, passwordVisible bool, errors []string) (bool, []string) {
+	var signals []string
+	if !navigated {
+		signals = append(signals, "still on the login URL")
+	}
+	if passwordVisible {
+		signals = append(signals, "password field still present")
+	}
+	if len(errors) > 0 {
+		signals = append(signals, "error messages on page")
+	}
+	return passwordVisible || len(errors) > 0, signals
+}
+
+// elementText returns the trimmed textContent of the first element matching
+// selector, or an error when nothing matches
+func elementText(ctx context.Context, selector string) (string, error) {
+	var match struct {
+		Found bool   `json:"found"`
+		Text  string `json:"text"`
+	}
+	err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(
+		`(() => { const el = document.querySelector(%s); return el ? {found: true, text: el.textContent.trim()} : {found: false}; })()`,
+		jsString(selector),
+	), &match))
+	if err != nil {
+		return "", fmt.Errorf("could not query %q: %v", selector, err)
+	}
+	if !match.Found {
+		return "", fmt.Errorf("no element matches %q", selector)
+	}
+	return match.Text, nil
+}
+
+// parseAttributeSpec splits an --attribute "<css>@<attr>" spec. The last @
+// separates the attribute so selectors like a[href^="mailto:x@y"] still work
+func parseAttributeSpec(spec string) (string, string, error) {
+	i := strings.LastIndex(spec, "@")
+	if i <= 0 || i == len(spec)-1 {
+		return "", "", fmt.Errorf("invalid --attribute %q (expected <css>@<attr>, e.g. a.download@href)", spec)
+	}
+	return spec[:i], spec[i+1:], nil
+}
+
+// extractAttributes reads the attribute of the first element matching each
+// "<css>@<attr>" spec. A single spec prints the bare value; several print a
+// JSON object keyed by spec
+func extractAttributes(ctx context.Context, specs []string) (string, error) {
+	values := make(map[string]string)
+	for _, spec := range specs {
+		selector, attr, err := parseAttributeSpec(spec)
+		if err != nil {
+			return "", err
+		}
+
+		var match struct {
+			Found bool    `json:"found"`
+			Value *string `json:"value"`
+		}
+		err = chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(
+			`(() => { const el = document.querySelector(%s); return el ? {found: true, value: el.getAttribute(%s)} : {found: false}; })()`,
+			jsString(selector), jsString(attr),
+		), &match))
+		if err != nil {
+			return "", fmt.Errorf("could not query %q: %v", selector, err)
+		}
+		if !match.Found {
+			return "", fmt.Errorf("no element matches %q", selector)
+		}
+		if match.Value == nil {
+			return "", fmt.Errorf("element %q has no %q attribute", selector, attr)
+		}
+		values[spec] = *match.Value
+	}
+
+	if len(specs) == 1 {
+		return values[specs[0]], nil
+	}
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// extractAttributeAll reads attr from every element matching selector, one
+// value per line or as a JSON array. Elements without the attribute are
+// skipped
+func extractAttributeAll(ctx context.Context, selector, attr string, asJSON bool) (string, error) {
+	var match struct {
+		Count  int      `json:"count"`
+		Values []string `json:"values"`
+	}
+	err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(
+		`(() => { const els = Array.from(document.querySelectorAll(%s)); return {count: els.length, values: els.map(e => e.getAttribute(%s)).filter(v => v !== null)}; })()`,
+		jsString(selector), jsString(attr),
+	), &match))
+	if err != nil {
+		return "", fmt.Errorf("could not query %q: %v", selector, err)
+	}
+	if match.Count == 0 {
+		return "", fmt.Errorf("no element matches %q", selector)
+	}
+
+	if asJSON {
+		if match.Values == nil {
+			match.Values = []string{}
+		}
+		data, err := json.MarshalIndent(match.Values, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return strings.Join(match.Values, "\n"), nil
+}
+
+// EXTRACT_JS parses page HTML and returns the outerHTML of every element
+// matching each selector, so iframe and shadow DOM content can be scoped too
+const EXTRACT_JS = `((html, selectors) => {
+	const doc = new DOMParser().parseFromString(html, 'text/html');
+	return selectors.map(selector => Array.from(doc.querySelectorAll(selector), el => el.outerHTML));
+})(%s, %s)`
+
+// extractElements narrows content to the elements matching --extract, in
+// selector order, as a document of its own for conversion
+func extractElements(ctx context.Context, content string, selectors []string) (string, error) {
+	selectorsJSON, _ := json.Marshal(selectors)
+	var matches [][]string
+	err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(EXTRACT_JS, jsString(content), selectorsJSON), &matches))
+	if err != nil {
+		return "", fmt.Errorf("could not extract elements: %v", err)
+	}
+
+	var parts []string
+	for i, selector := range selectors {
+		if len(matches[i]) == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: no element matches --extract %q\n", selector)
+		}
+		parts = append(parts, matches[i]...)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("no element matches --extract")
+	}
+	return "<html><body>\n" + strings.Join(parts, "\n") + "\n</body></html>", nil
+}
+
+// countElements returns how many elements match selector. With failOnZero,
+// an empty match is reported as a checkFailure so main exits with status 2
+func countElements(ctx context.Context, selector string, failOnZero bool) (string, error) {
+	var count int
+	err := chromedp.Run(ctx, chromedp.Evaluate(
+		fmt.Sprintf(`document.querySelectorAll(%s).length`, jsString(selector)),
+		&count,
+	))
+	if err != nil {
+		return "", fmt.Errorf("could not query %q: %v", selector, err)
+	}
+	if count == 0 && failOnZero {
+		return "0", &checkFailure{fmt.Sprintf("no elements match %q", selector)}
+	}
+	return strconv.Itoa(count), nil
+}
+
+// ImageInfo is an image found by --images
+type ImageInfo struct {
+	URL string `json:"url"`
+	Alt string `json:"alt"`
+}
+
+// rawImage holds the URL-bearing attributes of an <img> as written in the page
+type rawImage struct {
+	Src        string `json:"src"`
+	Srcset     string `json:"srcset"`
+	DataSrc    string `json:"dataSrc"`
+	DataSrcset string `json:"dataSrcset"`
+	Alt        string `json:"alt"`
+}
+
+// IMAGES_JS reads every <img>, including lazy ones whose real URL is still in
+// a data-* attribute, along with the base URL to resolve them against
+const IMAGES_JS = `({
+	base: document.baseURI,
+	images: Array.from(document.querySelectorAll('img'), img => ({
+		src: img.getAttribute('src') || '',
+		srcset: img.getAttribute('srcset') || '',
+		dataSrc: img.getAttribute('data-src') || img.getAttribute('data-lazy-src') || img.getAttribute('data-original') || '',
+		dataSrcset: img.getAttribute('data-srcset') || img.getAttribute('data-lazy-srcset') || '',
+		alt: img.getAttribute('alt') || ''
+	}))
+})`
+
+// bestSrcsetCandidate returns the largest candidate of a srcset, preferring
+// width descriptors over pixel densities. Data URIs are skipped since they
+// are placeholders and their commas can't be split reliably
+func bestSrcsetCandidate(srcset string) string {
+	best, bestWidth, bestDensity := "", 0.0, 0.0
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "data:") {
+			continue
+		}
+		descriptor := "1x"
+		if len(fields) > 1 {
+			descriptor = fields[1]
+		}
+		value, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64)
+		if err != nil {
+			continue
+		}
+		switch descriptor[len(descriptor)-1] {
+		case 'w':
+			if value > bestWidth {
+				best, bestWidth = fields[0], value
+			}
+		case 'x':
+			if bestWidth == 0 && value > bestDensity {
+				best, bestDensity = fields[0], value
+			}
+		}
+	}
+	return best
+}
+
+// imageURL picks the most useful URL of an image: the best srcset candidate,
+// then the lazy-load attribute, then src, resolved against base. It returns
+// "" when the image only has a placeholder
+func imageURL(img rawImage, base *url.URL) string {
+	for _, candidate := range []string{
+		bestSrcsetCandidate(img.DataSrcset),
+		bestSrcsetCandidate(img.Srcset),
+		img.DataSrc,
+		img.Src,
+	} {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "" || strings.HasPrefix(candidate, "data:") {
+			continue
+		}
+		ref, err := url.Parse(candidate)
+		if err != nil {
+			continue
+		}
+		return base.ResolveReference(ref).String()
+	}
+	return ""
+}
+
+// extractImages returns the absolute URL and alt text of every image on the
+// page as JSON, de-duplicated by URL in document order
+func extractImages(ctx context.Context) (string, error) {
+	var page struct {
+		Base   string     `json:"base"`
+		Images []rawImage `json:"images"`
+	}
+	if err := chromedp.Run(ctx, chromedp.Evaluate(IMAGES_JS, &page)); err != nil {
+		return "", fmt.Errorf("could not collect images: %v", err)
+	}
+	base, err := url.Parse(page.Base)
+	if err != nil {
+		return "", fmt.Errorf("could not parse page URL %q: %v", page.Base, err)
+	}
+
+	seen := make(map[string]bool)
+	images := []ImageInfo{}
+	for _, img := range page.Images {
+		u := imageURL(img, base)
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		images = append(images, ImageInfo{URL: u, Alt: strings.TrimSpace(img.Alt)})
+	}
+
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// imageClient returns the HTTP client --save-images downloads with. It goes
+// through the same proxy as the browser, with the --proxy-auth credentials,
+// so downloads don't leak the real IP or fail behind proxy-only access
+func imageClient(config Config) (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if config.Proxy == "" {
+		return client, nil
+	}
+	proxy := config.Proxy
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse proxy %q: %v", config.Proxy, err)
+	}
+	if user, pass, ok := strings.Cut(config.ProxyAuth, ":"); ok {
+		proxyURL.User = url.UserPassword(user, pass)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client.Transport = transport
+	return client, nil
+}
+
+// saveImages downloads every image in content into dir and replaces each
+// <img> with a markdown link to its local copy, or to the remote URL if the
+// download failed. Lazy-load attributes and srcset are resolved like
+// --images does, and requests carry the browser's cookies and user agent so
+// images behind a login download too
+func saveImages(ctx context.Context, config Config, content string) (string, error) {
+	dir := config.SaveImagesDir
+	client, err := imageClient(config)
+	if err != nil {
+		return "", err
+	}
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	var baseURI, userAgent string
+	if err := chromedp.Run(ctx,
+		chromedp.Evaluate(`document.baseURI`, &baseURI),
+		chromedp.Evaluate(`navigator.userAgent`, &userAgent),
+	); err != nil {
+		return "", err
+	}
+	base, err := url.Parse(baseURI)
+	if err != nil {
+		return "", fmt.Errorf("could not parse page URL %q: %v", baseURI, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	var images []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Img {
+			images = append(images, n)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	saved := make(map[string]string)
+	usedNames := make(map[string]bool)
+	savedCount, failed := 0, 0
+	for _, img := range images {
+		attr := func(names ...string) string {
+			for _, name := range names {
+				for _, a := range img.Attr {
+					if a.Key == name && a.Val != "" {
+						return a.Val
+					}
+				}
+			}
+			return ""
+		}
+		link := imageURL(rawImage{
+			Src:        attr("src"),
+			Srcset:     attr("srcset"),
+			DataSrc:    attr("data-src", "data-lazy-src", "data-original"),
+			DataSrcset: attr("data-srcset", "data-lazy-srcset"),
+		}, base)
+		if link == "" {
+			continue
+		}
+
+		local, done := saved[link]
+		if !done {
+			local, err = downloadImage(ctx, client, link, baseURI, userAgent, dir, usedNames)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Could not save image %s: %v\n", link, err)
+				local = link
+				failed++
+			} else {
+				savedCount++
+			}
+			saved[link] = local
+		}
+
+		alt := strings.NewReplacer("[", "", "]", "").Replace(strings.TrimSpace(attr("alt")))
+		img.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: fmt.Sprintf(" ![%s](%s) ", alt, local)}, img)
+		img.Parent.RemoveChild(img)
+	}
+	if savedCount+failed > 0 {
+		fmt.Fprintf(os.Stderr, "Saved %d of %d images to %s\n", savedCount, savedCount+failed, dir)
+	}
+
+	var out strings.Builder
+	if err := html.Render(&out, doc); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// downloadImage fetches link with the browser's cookies for it and writes it
+// into dir under a name not yet in usedNames, returning the file's path
+func downloadImage(ctx context.Context, client *http.Client, link, referer, userAgent, dir string, usedNames map[string]bool) (string, error) {
+	var cookies []*network.Cookie
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		cookies, err = network.GetCookies().WithURLs([]string{link}).Do(ctx)
+		return err
+	}))
+	if err != nil {
+		return "", fmt.Errorf("could not read cookies: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Referer", referer)
+	for _, c := range cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	filePath := filepath.Join(dir, imageFileName(link, resp.Header.Get("Content-Type"), usedNames))
+	f, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		os.Remove(filePath)
+		return "", err
+	}
+	return filepath.ToSlash(filePath), nil
+}
+
+// unsafeFileCharRe matches characters kept out of saved image file names
+var unsafeFileCharRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// imageFileName derives a file name from an image URL's last path segment,
+// adding an extension from the content type when it has none and a numeric
+// suffix when the name is already taken
+func imageFileName(link, contentType string, usedNames map[string]bool) string {
+	name := "image"
+	if u, err := url.Parse(link); err == nil {
+		if segment := path.Base(u.Path); segment != "/" && segment != "." {
+			if unescaped, err := url.PathUnescape(segment); err == nil {
+				segment = unescaped
+			}
+			if cleaned := strings.Trim(unsafeFileCharRe.ReplaceAllString(segment, "_"), "._"); cleaned != "" {
+				name = cleaned
+			}
+		}
+	}
+	if filepath.Ext(name) == "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+				name += exts[0]
+			}
+		}
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; usedNames[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+	usedNames[candidate] = true
+	return candidate
+}
+
+// IFRAME_JS finds an iframe by CSS selector, name or id and returns its
+// document's HTML. contentDocument is null for cross-origin frames
+const IFRAME_JS = `((query) => {
+	const isFrame = el => el && (el.tagName === 'IFRAME' || el.tagName === 'FRAME');
+	let frame = null;
+	try {
+		frame = document.querySelector(query);
+	} catch (e) {}
+	if (!isFrame(frame)) {
+		frame = Array.from(document.querySelectorAll('iframe, frame')).find(f => f.name === query || f.id === query) || null;
+	}
+	if (!frame) {
+		return {found: false};
+	}
+	let doc = null;
+	try {
+		doc = frame.contentDocument;
+	} catch (e) {}
+	if (!doc || !doc.documentElement) {
+		return {found: true, src: frame.src};
+	}
+	return {found: true, src: frame.src, html: doc.documentElement.outerHTML};
+})(%s)`
+
+// iframeHTML returns the HTML of the same-origin iframe matching query
+func iframeHTML(ctx context.Context, query string) (string, error) {
+	var frame struct {
+		Found bool    `json:"found"`
+		Src   string  `json:"src"`
+		HTML  *string `json:"html"`
+	}
+	if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(IFRAME_JS, jsString(query)), &frame)); err != nil {
+		return "", fmt.Errorf("could not look up iframe %q: %v", query, err)
+	}
+	if !frame.Found {
+		return "", fmt.Errorf("no iframe matches %q (tried it as a CSS selector, name and id)", query)
+	}
+	if frame.HTML == nil {
+		return "", fmt.Errorf("iframe %q (%s) is cross-origin, so its content can't be read; open its URL directly instead", query, frame.Src)
+	}
+	return *frame.HTML, nil
+}
+
+// SHADOW_HTML_JS serializes the document with open shadow roots inlined
+// into their hosts, ahead of the light DOM children. It walks the live tree
+// and a clone side by side, since clones don't carry shadow roots. Roots
+// nested deeper than maxDepth are replaced by a note
+const SHADOW_HTML_JS = `((maxDepth) => {
+	let omitted = 0;
+	const inline = (orig, copy, depth) => {
+		if (orig.shadowRoot) {
+			const holder = document.createElement('div');
+			holder.setAttribute('data-surf-shadow-root', '');
+			if (depth >= maxDepth) {
+				omitted++;
+				const note = document.createElement('p');
+				note.textContent = '[shadow DOM content omitted: nested deeper than ' + maxDepth + ' levels]';
+				holder.appendChild(note);
+			} else {
+				// childNodes, so text set directly on the root is kept too
+				for (const child of orig.shadowRoot.childNodes) {
+					const childCopy = child.cloneNode(true);
+					holder.appendChild(childCopy);
+					if (child.nodeType === Node.ELEMENT_NODE) {
+						inline(child, childCopy, depth + 1);
+					}
+				}
+			}
+			copy.insertBefore(holder, copy.firstChild);
+		}
+		const origChildren = orig.children;
+		const copyChildren = Array.from(copy.children).filter(el => !el.hasAttribute('data-surf-shadow-root'));
+		for (let i = 0; i < origChildren.length; i++) {
+			inline(origChildren[i], copyChildren[i], depth);
+		}
+	};
+	const root = document.documentElement;
+	const copy = root.cloneNode(true);
+	inline(root, copy, 0);
+	return {html: copy.outerHTML, omitted};
+})(%d)`
+
+// shadowHTML returns the page HTML with open shadow roots inlined up to
+// maxDepth levels, warning when deeper ones had to be left out
+func shadowHTML(ctx context.Context, maxDepth int) (string, error) {
+	var result struct {
+		HTML    string `json:"html"`
+		Omitted int    `json:"omitted"`
+	}
+	if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(SHADOW_HTML_JS, maxDepth), &result)); err != nil {
+		return "", fmt.Errorf("could not get page content with shadow DOM: %v", err)
+	}
+	if result.Omitted > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Omitted %d shadow root(s) nested deeper than %d levels (raise with --shadow-depth)\n", result.Omitted, maxDepth)
+	}
+	return result.HTML, nil
+}
+
+// printPDF renders the page as a paginated PDF with backgrounds. With
+// --window-size the paper matches the window (96 CSS pixels per inch);
+// otherwise Chromium's default Letter size is used
+func printPDF(ctx context.Context, config Config) ([]byte, error) {
+	params := page.PrintToPDF().WithPrintBackground(true)
+	if config.WindowSize != "" {
+		width, height := pdfPaperSize(config.WindowSize, config.PDFLandscape)
+		params = params.WithPaperWidth(width).WithPaperHeight(height)
+	} else {
+		params = params.WithLandscape(config.PDFLandscape)
+	}
+
+	var pdf []byte
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		data, _, err := params.Do(ctx)
+		pdf = data
+		return err
+	}))
+	return pdf, err
+}
+
+// pdfPaperSize is the paper in inches for a --window-size. Chromium would
+// rotate a window-shaped page again for landscape, so --pdf-landscape only
+// puts the longer side across instead
+func pdfPaperSize(windowSize string, landscape bool) (float64, float64) {
+	width, height := parseWindowSize(windowSize)
+	if landscape && width < height {
+		width, height = height, width
+	}
+	return float64(width) / 96, float64(height) / 96
+}
+
+// elementScreenshot captures the first element matching selector, failing
+// up front when nothing matches instead of waiting for it to appear
+func elementScreenshot(ctx context.Context, selector string, padding int) ([]byte, error) {
+	var count int
+	err := chromedp.Run(ctx, chromedp.Evaluate(
+		fmt.Sprintf(`document.querySelectorAll(%s).length`, jsString(selector)),
+		&count,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("could not query %q: %v", selector, err)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no element matches --screenshot-selector %q", selector)
+	}
+
+	var screenshot []byte
+	if padding == 0 {
+		err = chromedp.Run(ctx, chromedp.Screenshot(selector, &screenshot, chromedp.ByQuery))
+		return screenshot, err
+	}
+
+	// Widen the element's clip by the padding, within the page
+	var box struct {
+		X          float64 `json:"x"`
+		Y          float64 `json:"y"`
+		Width      float64 `json:"width"`
+		Height     float64 `json:"height"`
+		PageWidth  float64 `json:"pageWidth"`
+		PageHeight float64 `json:"pageHeight"`
+	}
+	err = chromedp.Run(ctx,
+		chromedp.ScrollIntoView(selector, chromedp.ByQuery),
+		chromedp.Evaluate(fmt.Sprintf(ELEMENT_BOX_JS, jsString(selector)), &box),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not measure %q: %v", selector, err)
+	}
+	clip := paddedClip(box.X, box.Y, box.Width, box.Height, box.PageWidth, box.PageHeight, float64(padding))
+	err = chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		data, err := page.CaptureScreenshot().
+			WithClip(clip).
+			WithCaptureBeyondViewport(true).
+			WithFromSurface(true).
+			Do(ctx)
+		screenshot = data
+		return err
+	}))
+	return screenshot, err
+}
+
+// ELEMENT_BOX_JS returns the first match's box in page coordinates along
+// with the page's scrollable size
+const ELEMENT_BOX_JS = `((selector) => {
+	const rect = document.querySelector(selector).getBoundingClientRect();
+	const root = document.documentElement;
+	return {
+		x: rect.left + window.scrollX,
+		y: rect.top + window.scrollY,
+		width: rect.width,
+		height: rect.height,
+		pageWidth: Math.max(root.scrollWidth, document.body ? document.body.scrollWidth : 0),
+		pageHeight: Math.max(root.scrollHeight, document.body ? document.body.scrollHeight : 0),
+	};
+})(%s)`
+
+// paddedClip grows an element's box by padding on every side, clamped to
+// the page so the capture never reaches past its edges
+func paddedClip(x, y, width, height, pageWidth, pageHeight, padding float64) *page.Viewport {
+	left := math.Max(0, x-padding)
+	top := math.Max(0, y-padding)
+	right := x + width + padding
+	bottom := y + height + padding
+	if pageWidth > 0 {
+		right = math.Min(pageWidth, right)
+	}
+	if pageHeight > 0 {
+		bottom = math.Min(pageHeight, bottom)
+	}
+	return &page.Viewport{X: left, Y: top, Width: math.Max(1, right-left), Height: math.Max(1, bottom-top), Scale: 1}
+}
+
+// maxScrollSteps caps --scroll on endless feeds; scrollPause gives lazy
+// content time to load after each step
+const (
+	maxScrollSteps = 30
+	scrollPause    = 500 * time.Millisecond
+)
+
+// autoScroll scrolls to the bottom of the page one viewport at a time,
+// pausing after each step, until the scroll height stops growing or
+// maxSteps is reached. It ends back at the top so captures start there
+func autoScroll(maxSteps int, pause time.Duration) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var height, lastHeight float64
+		for step := 0; step < maxSteps; step++ {
+			var position struct {
+				Bottom float64 `json:"bottom"`
+				Height float64 `json:"height"`
+			}
+			err := chromedp.Evaluate(`(() => {
+	window.scrollBy(0, window.innerHeight);
+	return {bottom: window.scrollY + window.innerHeight, height: document.body.scrollHeight};
+})()`, &position).Do(ctx)
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pause):
+			}
+
+			// Done once at the bottom and nothing new was appended
+			if err := chromedp.Evaluate(`document.body.scrollHeight`, &height).Do(ctx); err != nil {
+				return err
+			}
+			if position.Bottom >= height && height == lastHeight {
+				break
+			}
+			lastHeight = height
+			if step == maxSteps-1 {
+				fmt.Fprintf(os.Stderr, "Warning: Stopped scrolling after %d steps; the page may keep loading more\n", maxSteps)
+			}
+		}
+		var ignored interface{}
+		return chromedp.Evaluate(`window.scrollTo(0, 0)`, &ignored).Do(ctx)
+	})
+}
+
+// maxStitchHeight caps --stitch captures, in CSS pixels, so endless feeds
+// don't exhaust memory
+const maxStitchHeight = 50000
+
+// stitchedScreenshot captures a tall page by scrolling one viewport at a
+// time and joining the slices into one PNG. Fixed and sticky elements are
+// kept in the first slice and hidden for the rest
+func stitchedScreenshot(ctx context.Context) ([]byte, error) {
+	var metrics struct {
+		Width          float64 `json:"width"`
+		ViewportHeight float64 `json:"viewportHeight"`
+		PageHeight     float64 `json:"pageHeight"`
+	}
+	err := chromedp.Run(ctx, chromedp.Evaluate(`({
+		width: window.innerWidth,
+		viewportHeight: window.innerHeight,
+		pageHeight: Math.max(document.documentElement.scrollHeight, document.body ? document.body.scrollHeight : 0)
+	})`, &metrics))
+	if err != nil {
+		return nil, fmt.Errorf("could not measure page: %v", err)
+	}
+	if metrics.ViewportHeight <= 0 {
+		return nil, fmt.Errorf("page has no viewport")
+	}
+	pageHeight := metrics.PageHeight
+	if pageHeight > maxStitchHeight {
+		fmt.Fprintf(os.Stderr, "Warning: Page is %.0fpx tall, stitching only the first %dpx\n", pageHeight, maxStitchHeight)
+		pageHeight = maxStitchHeight
+	}
+
+	var canvas *image.RGBA
+	scale := 1.0
+	hidden := false
+	defer func() {
+		var ignored interface{}
+		if hidden {
+			chromedp.Run(ctx, chromedp.Evaluate(RESTORE_FIXED_JS, &ignored))
+		}
+		chromedp.Run(ctx, chromedp.Evaluate(`window.scrollTo(0, 0)`, &ignored))
+	}()
+
+	for y := 0.0; y < pageHeight; y += metrics.ViewportHeight {
+		var scrollY float64
+		if err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(`window.scrollTo(0, %f); window.scrollY`, y), &scrollY)); err != nil {
+			return nil, fmt.Errorf("could not scroll: %v", err)
+		}
+		// Let lazy content and scroll-triggered layout settle
+		time.Sleep(150 * time.Millisecond)
+
+		var slice []byte
+		if err := chromedp.Run(ctx, chromedp.CaptureScreenshot(&slice)); err != nil {
+			return nil, fmt.Errorf("could not capture slice at %.0fpx: %v", y, err)
+		}
+		img, err := png.Decode(bytes.NewReader(slice))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode slice: %v", err)
+		}
+
+		if canvas == nil {
+			// Slices are in device pixels, which may differ from CSS pixels
+			scale = float64(img.Bounds().Dy()) / metrics.ViewportHeight
+			canvas = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), int(pageHeight*scale)))
+		}
+
+		// The last scroll is clamped at the page bottom, so skip the rows
+		// the previous slice already covered
+		skip := int((y - scrollY) * scale)
+		dest := image.Rect(0, int(y*scale), canvas.Bounds().Dx(), canvas.Bounds().Dy())
+		draw.Draw(canvas, dest, img, img.Bounds().Min.Add(image.Pt(0, skip)), draw.Src)
+
+		if !hidden {
+			var count int
+			chromedp.Run(ctx, chromedp.Evaluate(HIDE_FIXED_JS, &count))
+			hidden = true
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, canvas); err != nil {
+		return nil, fmt.Errorf("could not encode stitched screenshot: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// diffImagePath derives the diff image path from the screenshot path,
+// e.g. page.png -> page-diff.png
+func diffImagePath(screenshotPath string) string {
+	return strings.TrimSuffix(screenshotPath, filepath.Ext(screenshotPath)) + "-diff.png"
+}
+
+// compareScreenshot compares a PNG screenshot against the baseline at
+// baselinePath and writes a diff image highlighting changed pixels in red.
+// A missing baseline is created from the screenshot. Images of different
+// sizes are compared over their combined area, so pixels outside the smaller
+// image count as changed
+func compareScreenshot(screenshot []byte, baselinePath, diffPath string) (*ScreenshotDiff, error) {
+	if _, err := os.Stat(baselinePath); os.IsNotExist(err) {
+		if err := os.WriteFile(baselinePath, screenshot, 0644); err != nil {
+			return nil, fmt.Errorf("could not create baseline: %v", err)
+		}
+		return &ScreenshotDiff{BaselinePath: baselinePath, BaselineCreated: true}, nil
+	}
+
+	current, err := png.Decode(bytes.NewReader(screenshot))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode screenshot: %v", err)
+	}
+	baselineFile, err := os.Open(baselinePath)
+	if err != nil {
+		return nil, err
+	}
+	defer baselineFile.Close()
+	baseline, _, err := image.Decode(baselineFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode baseline %s: %v", baselinePath, err)
+	}
+
+	diff := &ScreenshotDiff{BaselinePath: baselinePath, DiffPath: diffPath}
+	cb, bb := current.Bounds(), baseline.Bounds()
+	if cb.Dx() != bb.Dx() || cb.Dy() != bb.Dy() {
+		diff.SizeMismatch = fmt.Sprintf("%dx%d vs baseline %dx%d", cb.Dx(), cb.Dy(), bb.Dx(), bb.Dy())
+	}
+
+	width, height := max(cb.Dx(), bb.Dx()), max(cb.Dy(), bb.Dy())
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	changed := color.RGBA{255, 0, 0, 255}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			inCurrent := x < cb.Dx() && y < cb.Dy()
+			inBaseline := x < bb.Dx() && y < bb.Dy()
+			if inCurrent && inBaseline {
+				c := color.RGBAModel.Convert(current.At(cb.Min.X+x, cb.Min.Y+y)).(color.RGBA)
+				b := color.RGBAModel.Convert(baseline.At(bb.Min.X+x, bb.Min.Y+y)).(color.RGBA)
+				if c == b {
+					// Unchanged pixels are faded so the red changes stand out
+					gray := uint8((uint32(c.R) + uint32(c.G) + uint32(c.B)) / 3)
+					fade := 192 + gray/4
+					out.SetRGBA(x, y, color.RGBA{fade, fade, fade, 255})
+					continue
+				}
+			}
+			out.SetRGBA(x, y, changed)
+			diff.ChangedPixels++
+		}
+	}
+
+	diff.TotalPixels = width * height
+	if diff.TotalPixels > 0 {
+		diff.Percent = float64(diff.ChangedPixels) * 100 / float64(diff.TotalPixels)
+	}
+
+	diffFile, err := os.Create(diffPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not create diff image: %v", err)
+	}
+	defer diffFile.Close()
+	if err := png.Encode(diffFile, out); err != nil {
+		return nil, fmt.Errorf("could not write diff image: %v", err)
+	}
+
+	return diff, nil
+}
+
+// headerRule adds one header to requests whose URL matches pattern
+type headerRule struct {
+	pattern string
+	re      *regexp.Regexp
+	name    string
+	value   string
+}
+
+// parseHeader splits a --header "Key: Value" at the first colon, so values
+// like "Bearer a:b" or URLs keep theirs
+func parseHeader(spec string) (string, string, error) {
+	name, value, ok := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid --header %q (expected \"Key: Value\")", spec)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// parseCookieSpec splits a --cookie "name=value" at the first "=", so values
+// may contain "=" themselves (base64 tokens often do)
+func parseCookieSpec(spec string) (string, string, error) {
+	name, value, ok := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid --cookie %q (expected name=value)", spec)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// parseStorageSpec splits a --local-storage "key=value" at the first "=".
+// Values are kept verbatim, since they are often JSON
+func parseStorageSpec(spec string) (string, string, error) {
+	key, value, ok := strings.Cut(spec, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid --local-storage %q (expected key=value)", spec)
+	}
+	return key, value, nil
+}
+
+// BLOCKABLE_RESOURCES maps --block-resources names to the CDP types they
+// abort. Documents, XHR and fetch are left alone so the page still loads
+var BLOCKABLE_RESOURCES = map[string]network.ResourceType{
+	"image":      network.ResourceTypeImage,
+	"media":      network.ResourceTypeMedia,
+	"font":       network.ResourceTypeFont,
+	"stylesheet": network.ResourceTypeStylesheet,
+	"script":     network.ResourceTypeScript,
+}
+
+// parseResourceTypes parses a comma-separated --block-resources list
+func parseResourceTypes(list string) (map[network.ResourceType]bool, error) {
+	types := make(map[network.ResourceType]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		resourceType, ok := BLOCKABLE_RESOURCES[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown --block-resources type %q (choose from: image, media, font, stylesheet, script)", name)
+		}
+		types[resourceType] = true
+	}
+	return types, nil
+}
+
+// parseHeaderFor parses a --header-for "<url-pattern>:Key:Value" spec. The
+// pattern ends at the first colon that isn't part of a scheme (://) or a
+// port, so "https://api.example.com:8443/*:Authorization:Bearer x" works.
+// Patterns use * and ? wildcards and match the full request URL; one
+// without a scheme matches any scheme
+func parseHeaderFor(spec string) (headerRule, error) {
+	invalid := fmt.Errorf("invalid --header-for %q (expected <url-pattern>:Key:Value, e.g. api.example.com/*:Authorization:Bearer token)", spec)
+
+	sep := -1
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != ':' {
+			continue
+		}
+		rest := spec[i+1:]
+		if strings.HasPrefix(rest, "//") || (rest != "" && rest[0] >= '0' && rest[0] <= '9') {
+			continue
+		}
+		sep = i
+		break
+	}
+	if sep <= 0 {
+		return headerRule{}, invalid
+	}
+
+	pattern := spec[:sep]
+	name, value, ok := strings.Cut(spec[sep+1:], ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return headerRule{}, invalid
+	}
+	if !strings.Contains(pattern, "://") {
+		pattern = "*://" + pattern
+	}
+
+	return headerRule{
+		pattern: pattern,
+		re:      globRegexp(pattern),
+		name:    name,
+		value:   strings.TrimSpace(value),
+	}, nil
+}
+
+// globRegexp compiles a URL pattern with * and ? wildcards, anchored at both ends
+func globRegexp(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// applyHeaderRules returns the request headers with every rule matching
+// requestURL applied, or nil when no rule matches
+func applyHeaderRules(rules []headerRule, requestURL string, original map[string]interface{}) []*fetch.HeaderEntry {
+	var matched []headerRule
+	for _, rule := range rules {
+		if rule.re.MatchString(requestURL) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	var headers []*fetch.HeaderEntry
+	for name, value := range original {
+		overridden := false
+		for _, rule := range matched {
+			if strings.EqualFold(rule.name, name) {
+				overridden = true
+			}
+		}
+		if !overridden {
+			headers = append(headers, &fetch.HeaderEntry{Name: name, Value: fmt.Sprint(value)})
+		}
+	}
+	for _, rule := range matched {
+		headers = append(headers, &fetch.HeaderEntry{Name: rule.name, Value: rule.value})
+	}
+	return headers
+}
+
+// pageLooksIncomplete reports whether the rendered page has almost no text,
+// which after an uncaught exception usually means rendering stopped midway
+func pageLooksIncomplete(ctx context.Context) bool {
+	var textLength int
+	err := chromedp.Run(ctx, chromedp.Evaluate(`document.body ? document.body.innerText.trim().length : 0`, &textLength))
+	return err == nil && textLength < 200
+}
+
+// scopedJS wraps code for --js-in so it runs with this and el bound to the
+// first element matching selector, and root bound to that element's open
+// shadow root or iframe document (or the element itself). Direct eval keeps
+// the snippet's completion value as the result, just like unscoped --js
+func scopedJS(selector, code string) string {
+	return fmt.Sprintf(`(() => {
+	const el = document.querySelector(%[1]s);
+	if (!el) throw new Error('--js-in: no element matches ' + %[1]s);
+	const root = el.shadowRoot || el.contentDocument || el;
+	return (function (el, root) { return eval(%[2]s); }).call(el, el, root);
+})()`, jsString(selector), jsString(code))
+}
+
+// templateFuncs are available to --template in addition to Go's builtins
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"csv": func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	},
+}
+
+// parseOutputTemplate parses a --template against the PageResult fields
+func parseOutputTemplate(text string) (*template.Template, error) {
+	return template.New("output").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// renderPageResult fills in the URLs, title and console messages of a
+// structured result and renders it as JSON, or with --template
+func renderPageResult(ctx context.Context, config Config, baseURL string, result PageResult, messages []ConsoleMessage) (string, error) {
+	chromedp.Run(ctx, chromedp.Location(&result.FinalURL), chromedp.Title(&result.Title))
+	result.URL = baseURL
+	if result.URL == "" {
+		result.URL = result.FinalURL
+	}
+
+	result.Console = []ConsoleLine{}
+	for _, m := range messages {
+		result.Console = append(result.Console, ConsoleLine{Level: m.Level, Text: m.Text})
+	}
+
+	if config.Template != "" {
+		tmpl, err := parseOutputTemplate(config.Template)
+		if err != nil {
+			return "", fmt.Errorf("invalid --template: %v", err)
+		}
+		var out strings.Builder
+		if err := tmpl.Execute(&out, result); err != nil {
+			return "", fmt.Errorf("could not render --template: %v", err)
+		}
+		return out.String(), nil
+	}
+
+	return encodePageResult(config, result)
+}
+
+// encodePageResult renders a result as indented JSON, or on a single line
+// with --jsonl so every result is its own parseable line
+func encodePageResult(config Config, result PageResult) (string, error) {
+	var data []byte
+	var err error
+	if config.JSONLines {
+		data, err = json.Marshal(result)
+	} else {
+		data, err = json.MarshalIndent(result, "", "  ")
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not encode JSON output: %v", err)
+	}
+	return string(data), nil
+}
+
+// jsString quotes s as a JavaScript string literal
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// formatSection renders a titled block to append after the page content
+func formatSection(title string, lines []string) string {
+	section := "\n\n" + strings.Repeat("=", 50) + "\n" + title + ":\n" + strings.Repeat("=", 50) + "\n"
+	for _, line := range lines {
+		section += line + "\n"
+	}
+	return section
+}
+
+// formatBanner renders the URL header above the page content in the
+// --banner style: the default box, a markdown H1, or nothing. Details such
+// as the final URL go on lines of their own under the URL
+func formatBanner(style, pageURL string, details []string) string {
+	switch style {
+	case "markdown":
+		if len(details) > 0 {
+			return "# " + pageURL + "\n\n" + strings.Join(details, "\n") + "\n\n"
+		}
+		return "# " + pageURL + "\n\n"
+	case "none":
+		return ""
+	}
+	for _, detail := range details {
+		pageURL += "\n" + detail
+	}
+	return "==========================\n" + pageURL + "\n==========================\n\n"
+}
+
+// statusLine describes an HTTP status for the header, e.g. "Status: 404 Not Found"
+func statusLine(status int64) string {
+	if text := http.StatusText(int(status)); text != "" {
+		return fmt.Sprintf("Status: %d %s", status, text)
+	}
+	return fmt.Sprintf("Status: %d", status)
+}
+
+// sameURL reports whether two URLs differ only by a trailing slash, as the
+// browser adds one to bare origins
+func sameURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// formatBannerSection renders a section in the --banner style. Markdown
+// sections are H2s so they nest under the page's H1; with no banner they
+// keep only their title line
+func formatBannerSection(style, title string, lines []string) string {
+	var section string
+	switch style {
+	case "markdown":
+		section = "\n\n## " + title + "\n\n"
+	case "none":
+		section = "\n\n" + title + ":\n"
+	default:
+		return formatSection(title, lines)
+	}
+	for _, line := range lines {
+		section += line + "\n"
+	}
+	return section
+}
+
+// eventTime converts a CDP timestamp, falling back to now when it is missing
+func eventTime(ts *cdpruntime.Timestamp) time.Time {
+	if ts == nil {
+		return time.Now()
+	}
+	return ts.Time()
+}
+
+// stackSource formats the top stack frame as url:line:column (1-based)
+func stackSource(trace *cdpruntime.StackTrace) string {
+	if trace == nil || len(trace.CallFrames) == 0 {
+		return ""
+	}
+	frame := trace.CallFrames[0]
+	if frame.URL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", frame.URL, frame.LineNumber+1, frame.ColumnNumber+1)
+}
+
+// writeConsoleOutput saves the captured console messages as a JSON array
+func writeConsoleOutput(path string, messages []ConsoleMessage) error {
+	if messages == nil {
+		messages = []ConsoleMessage{}
+	}
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// consoleBufferFile is where a session tab's console is kept for --console-buffer
+func consoleBufferFile(targetID string) string {
+	return filepath.Join(getSessionsDir(), "console", targetID+".json")
+}
+
+// appendConsoleBuffer adds messages to the buffer stored at path, keeps the
+// newest limit entries, and returns the updated buffer
+func appendConsoleBuffer(path string, messages []ConsoleMessage, limit int) ([]ConsoleMessage, error) {
+	buffer := []ConsoleMessage{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &buffer); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	buffer = append(buffer, messages...)
+	if len(buffer) > limit {
+		buffer = buffer[len(buffer)-limit:]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := writeConsoleOutput(path, buffer); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// formatJSResult renders a --js return value: strings as they are, anything
+// else as JSON
+func formatJSResult(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// maxCanonicalHops caps --follow-canonical so pages whose canonical links
+// point at each other can't loop
+const maxCanonicalHops = 3
+
+// followCanonical navigates to the page's <link rel=canonical> while it
+// names a URL not visited yet, and returns the URLs visited in order
+func followCanonical(ctx context.Context) ([]string, error) {
+	var current string
+	if err := chromedp.Run(ctx, chromedp.Location(&current)); err != nil {
+		return nil, fmt.Errorf("could not read page URL: %v", err)
+	}
+	chain := []string{current}
+	seen := map[string]bool{stripFragment(current): true}
+
+	for hop := 0; hop < maxCanonicalHops; hop++ {
+		var canonical string
+		chromedp.Run(ctx, chromedp.Evaluate(`(document.querySelector('link[rel~="canonical" i][href]') || {}).href || ""`, &canonical))
+		if canonical == "" || seen[stripFragment(canonical)] {
+			return chain, nil
+		}
+		seen[stripFragment(canonical)] = true
+
+		fmt.Fprintf(os.Stderr, "Following canonical URL: %s\n", canonical)
+		if err := chromedp.Run(ctx, chromedp.Navigate(canonical), chromedp.WaitReady("body")); err != nil {
+			return nil, fmt.Errorf("could not load canonical URL %s: %v", canonical, err)
+		}
+		chain = append(chain, canonical)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: Stopped following canonical links after %d hops\n", maxCanonicalHops)
+	return chain, nil
+}
+
+// canonicalLines renders the --follow-canonical chain for the text output
+func canonicalLines(chain []string) []string {
+	lines := []string{"Requested: " + chain[0], "Canonical: " + chain[len(chain)-1]}
+	if len(chain) > 2 {
+		lines = append(lines, "Via: "+strings.Join(chain[1:len(chain)-1], " -> "))
+	}
+	return lines
+}
+
+// clickElement clicks the first element matching selector once it is
+// visible, failing right away when nothing matches and after --wait-timeout
+// when it never becomes visible
+func clickElement(ctx context.Context, config Config, selector string) error {
+	var count int
+	err := chromedp.Run(ctx, chromedp.Evaluate(
+		fmt.Sprintf(`document.querySelectorAll(%s).length`, jsString(selector)),
+		&count,
+	))
+	if err != nil {
+		return fmt.Errorf("could not query %q: %v", selector, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("no element matches --click %q", selector)
+	}
+
+	if config.HumanMouse {
+		chromedp.Run(ctx, humanMouseMove(selector))
+	}
+
+	clickCtx, cancel := context.WithTimeout(ctx, time.Duration(config.WaitTimeout)*time.Millisecond)
+	defer cancel()
+	if err := runAction(clickCtx, config, chromedp.Click(selector, chromedp.ByQuery, chromedp.NodeVisible)); err != nil {
+		return fmt.Errorf("could not click %q (is it visible?): %v", selector, err)
+	}
+	return nil
+}
+
+// waitAfterJS gives navigation started by a --js step time to settle
+func waitAfterJS(ctx context.Context, isLiveView bool, currentURL string) {
+	// Wait for navigation based on page type
+	if isLiveView {
+		fmt.Fprintln(os.Stderr, "Waiting for Phoenix LiveView navigation...")
+		time.Sleep(500 * time.Millisecond)
+
+		var newURL string
+		chromedp.Run(ctx, chromedp.Location(&newURL))
+		if newURL != currentURL {
+			fmt.Fprintln(os.Stderr, "URL changed, waiting for page to stabilize...")
+			time.Sleep(500 * time.Millisecond)
+		} else {
+			fmt.Fprintln(os.Stderr, "Info: No navigation detected (in-place LiveView update)")
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "Waiting for page navigation...")
+		time.Sleep(200 * time.Millisecond)
+
+		var newURL string
+		chromedp.Run(ctx, chromedp.Location(&newURL))
+
+		if newURL != currentURL {
+			fmt.Fprintln(os.Stderr, "Navigation detected, waiting for page load...")
+			if err := chromedp.Run(ctx, chromedp.WaitReady("body")); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Page load wait timed out: %v\n", err)
+			} else {
+				fmt.Fprintln(os.Stderr, "Page load completed")
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, "Info: No navigation detected (page update without URL change)")
+		}
+	}
+}
+
+// manualTargetIsURL reports whether a --wait-for-manual target is a URL (absolute
+// or starting with /) rather than a CSS selector
+func manualTargetIsURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "/")
+}
+
+// waitForManual blocks until the page is past a challenge a person solves by
+// hand: target is either a selector that appears or a URL the page reaches
+func waitForManual(ctx context.Context, target string) error {
+	done := func() bool {
+		if manualTargetIsURL(target) {
+			var currentURL string
+			chromedp.Run(ctx, chromedp.Location(&currentURL))
+			return strings.HasPrefix(currentURL, resolveAfterSubmitURL(target, currentURL))
+		}
+		var found bool
+		chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(`document.querySelector(%s) !== null`, jsString(target)), &found))
+		return found
+	}
+	if done() {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Waiting for you to finish in the browser window (until %s is reached)...\n", target)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for %s: %v", target, ctx.Err())
+		case <-ticker.C:
+			if done() {
+				fmt.Fprintln(os.Stderr, "Challenge cleared, continuing")
+				// The page reached may still be loading
+				chromedp.Run(ctx, chromedp.WaitReady("body"))
+				return nil
+			}
+		}
+	}
+}
+
+// waitForSelector waits for an element matching the selector to appear
+func waitForSelector(ctx context.Context, selector string, timeout time.Duration) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return chromedp.Run(timeoutCtx, chromedp.WaitVisible(selector))
+}
+
+// WAIT_FOR_ANY_JS returns the index of the first selector with a visible
+// match, or -1. Invalid selectors never match
+const WAIT_FOR_ANY_JS = `((selectors) => {
+	const visible = el => {
+		const style = getComputedStyle(el);
+		return style.visibility !== 'hidden' && style.display !== 'none' && el.getClientRects().length > 0;
+	};
+	for (let i = 0; i < selectors.length; i++) {
+		try {
+			if (Array.from(document.querySelectorAll(selectors[i])).some(visible)) {
+				return i;
+			}
+		} catch (e) {}
+	}
+	return -1;
+})(%s)`
+
+// waitForAnySelector polls until one of selectors matches a visible element
+// and returns that selector. Earlier selectors win when several match
+func waitForAnySelector(ctx context.Context, selectors []string, timeout time.Duration) (string, error) {
+	data, err := json.Marshal(selectors)
+	if err != nil {
+		return "", err
+	}
+	script := fmt.Sprintf(WAIT_FOR_ANY_JS, data)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		index := -1
+		if err := chromedp.Run(timeoutCtx, chromedp.Evaluate(script, &index)); err == nil && index >= 0 && index < len(selectors) {
+			return selectors[index], nil
+		}
+		select {
+		case <-timeoutCtx.Done():
+			return "", fmt.Errorf("none of %s appeared within %s", strings.Join(selectors, ", "), timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// splitSelectorList splits a comma-separated list of CSS selectors, leaving
+// commas inside brackets, parentheses and quotes alone, e.g. in :is(a, b)
+func splitSelectorList(list string) []string {
+	var selectors []string
+	depth := 0
+	var quote rune
+	start := 0
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			selectors = append(selectors, s)
+		}
+	}
+	for i, c := range list {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			if depth > 0 {
+				depth--
+			}
+		case c == ',' && depth == 0:
+			add(list[start:i])
+			start = i + 1
+		}
+	}
+	add(list[start:])
+	return selectors
+}
+
+// bareFormIDRe matches a --form value with no CSS syntax, which is taken as
+// a form id for compatibility with older scripts
+var bareFormIDRe = regexp.MustCompile(`^[A-Za-z_][\w-]*$`)
+
+// formSelector turns the --form value into a CSS selector for the form
+func formSelector(form string) string {
+	if bareFormIDRe.MatchString(form) {
+		return "#" + form
+	}
+	return form
+}
+
+// withinForm builds a selector list matching each of the given selectors
+// inside the form. :is() keeps a form selector list like "form.a, form.b"
+// from leaking into the outer list
+func withinForm(form string, selectors ...string) string {
+	scoped := make([]string, len(selectors))
+	for i, selector := range selectors {
+		scoped[i] = fmt.Sprintf(":is(%s) %s", formSelector(form), selector)
+	}
+	return strings.Join(scoped, ", ")
+}
+
+// FORM_FIELD_JS reports the tag and type of the first field in a form with
+// the given name. Failing that, the name is tried as a CSS selector for a
+// contenteditable region, in the form first and then the whole page
+const FORM_FIELD_JS = `((formSelector, name) => {
+	const form = document.querySelector(formSelector);
+	const field = form && Array.from(form.elements).find(el => el.name === name);
+	if (field) {
+		return {found: true, tag: field.tagName.toLowerCase(), type: (field.type || '').toLowerCase()};
+	}
+	let editable = null;
+	try {
+		editable = (form && form.querySelector(name)) || document.querySelector(name);
+	} catch (e) {}
+	return editable && editable.isContentEditable ? {found: true, tag: editable.tagName.toLowerCase(), editable: true} : {found: false};
+})(%s, %s)`
+
+// SELECT_EDITABLE_JS focuses a contenteditable region and selects all of its
+// content, so inserted text replaces it
+const SELECT_EDITABLE_JS = `((formSelector, selector) => {
+	const form = document.querySelector(formSelector);
+	const el = (form && form.querySelector(selector)) || document.querySelector(selector);
+	el.focus();
+	const range = document.createRange();
+	range.selectNodeContents(el);
+	const selection = window.getSelection();
+	selection.removeAllRanges();
+	selection.addRange(range);
+})(%s, %s)`
+
+// SELECT_OPTION_JS selects the option of a <select> whose value, or else
+// whose text, matches, firing the events a user's choice would
+const SELECT_OPTION_JS = `((formSelector, name, value) => {
+	const form = document.querySelector(formSelector);
+	const select = Array.from(form.elements).find(el => el.name === name && el.tagName === 'SELECT');
+	const options = Array.from(select.options);
+	const option = options.find(o => o.value === value) || options.find(o => o.text.trim() === value.trim());
+	if (!option) {
+		return {found: false, choices: options.map(o => o.value)};
+	}
+	option.selected = true;
+	select.dispatchEvent(new Event('input', {bubbles: true}));
+	select.dispatchEvent(new Event('change', {bubbles: true}));
+	return {found: true};
+})(%s, %s, %s)`
+
+// CHECK_FIELD_JS sets checkboxes and radios by clicking them when their
+// state needs to change. A lone checkbox takes on/off style values; a group
+// of checkboxes or radios is matched by the value attribute and checked
+const CHECK_FIELD_JS = `((formSelector, name, value) => {
+	const form = document.querySelector(formSelector);
+	const fields = Array.from(form.elements).filter(el => el.name === name && (el.type === 'checkbox' || el.type === 'radio'));
+	const on = ['true', 'on', 'yes', '1', 'checked'];
+	const off = ['false', 'off', 'no', '0', 'unchecked'];
+	const flag = value.trim().toLowerCase();
+	let target = null, checked = true;
+	if (fields.length === 1 && fields[0].type === 'checkbox' && (on.includes(flag) || off.includes(flag))) {
+		target = fields[0];
+		checked = on.includes(flag);
+	} else {
+		target = fields.find(el => el.value === value) || null;
+	}
+	if (!target) {
+		return {found: false, choices: fields.map(el => el.value)};
+	}
+	if (target.checked !== checked) {
+		target.click();
+	}
+	return {found: true};
+})(%s, %s, %s)`
+
+// fillFormField sets one --input according to the kind of field it names:
+// picks an option of a <select>, checks or unchecks a checkbox or radio, or
+// types into anything else. Fields that aren't rendered yet are waited for
+// as text inputs
+func fillFormField(ctx context.Context, config Config, input FormInput) error {
+	var field struct {
+		Found    bool   `json:"found"`
+		Tag      string `json:"tag"`
+		Type     string `json:"type"`
+		Editable bool   `json:"editable"`
+	}
+	chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(FORM_FIELD_JS, jsString(formSelector(config.FormID)), jsString(input.Name)), &field))
+
+	var script string
+	switch {
+	case field.Found && field.Tag == "select":
+		script = SELECT_OPTION_JS
+	case field.Found && (field.Type == "checkbox" || field.Type == "radio"):
+		script = CHECK_FIELD_JS
+	}
+	if script != "" {
+		var result struct {
+			Found   bool     `json:"found"`
+			Choices []string `json:"choices"`
+		}
+		err := runAction(ctx, config, chromedp.Evaluate(fmt.Sprintf(script, jsString(formSelector(config.FormID)), jsString(input.Name), jsString(input.Value)), &result))
+		if err != nil {
+			return err
+		}
+		if !result.Found {
+			return fmt.Errorf("no choice matches %q (choices: %s)", input.Value, strings.Join(result.Choices, ", "))
+		}
+		return nil
+	}
+
+	if field.Editable {
+		return fillEditable(ctx, config, input.Name, input.Value)
+	}
+
+	selector := withinForm(config.FormID, fmt.Sprintf("input[name='%s']", input.Name), fmt.Sprintf("textarea[name='%s']", input.Name))
+	var typeValue chromedp.Action = chromedp.SendKeys(selector, input.Value)
+	if config.InputDelayMax > 0 {
+		typeValue = humanSendKeys(selector, input.Value, config.InputDelayMin, config.InputDelayMax)
+	}
+	return runAction(ctx, config,
+		chromedp.WaitVisible(selector),
+		chromedp.Clear(selector),
+		typeValue,
+	)
+}
+
+// fillEditable replaces the content of a contenteditable region. Rich
+// editors ignore SendKeys' synthetic key events on anything but inputs, so
+// the text goes in through Input.insertText, which fires the beforeinput and
+// input events they listen for
+func fillEditable(ctx context.Context, config Config, selector, value string) error {
+	if config.HumanMouse {
+		chromedp.Run(ctx, humanMouseMove(selector))
+	}
+	return runAction(ctx, config, chromedp.ActionFunc(func(ctx context.Context) error {
+		err := chromedp.Evaluate(fmt.Sprintf(SELECT_EDITABLE_JS, jsString(formSelector(config.FormID)), jsString(selector)), nil).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			return chromedp.Evaluate(`document.execCommand('delete')`, nil).Do(ctx)
+		}
+		return input.InsertText(value).Do(ctx)
+	}))
+}
+
+func handleForm(ctx context.Context, config Config, isLiveView bool) (*FormResult, error) {
+	// Snapshot cookies so only those set by the submission are captured
+	var cookiesBefore []*network.Cookie
+	if config.CaptureCookiesPath != "" {
+		var err error
+		cookiesBefore, err = getCookies(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not read cookies: %v", err)
+		}
+	}
+
+	// Fill form inputs
+	for _, input := range config.Inputs {
+		randomWait(config)
+
+		if err := fillFormField(ctx, config, input); err != nil {
+			return nil, fmt.Errorf("could not fill input %s: %v", input.Name, err)
+		}
+	}
+
+	formSel := formSelector(config.FormID)
+	formResult := &FormResult{}
+	chromedp.Run(ctx, chromedp.Location(&formResult.FromURL))
+
+	// form.enctype normalizes missing or unknown values to urlencoded
+	chromedp.Run(ctx, chromedp.Evaluate(
+		fmt.Sprintf(`(document.querySelector(%s) || {}).enctype || ""`, jsString(formSel)),
+		&formResult.Enctype,
+	))
+
+	// Leave the filled form in place for --screenshot or --js
+	if config.NoSubmit {
+		fmt.Fprintln(os.Stderr, "Form filled, not submitted (--no-submit)")
+		formResult.Method = "none"
+		formResult.ToURL = formResult.FromURL
+		return formResult, nil
+	}
+	// Pressing Enter can bypass multipart encoding, so file-upload forms
+	// always go through the native submit path
+	multipart := formResult.Enctype == "multipart/form-data"
+
+	// Buttons without a type attribute submit too
+	submitSelector := withinForm(config.FormID, "input[type='submit']", "button[type='submit']", "button:not([type])")
+	var submitCount int
+	chromedp.Run(ctx, chromedp.Evaluate(
+		fmt.Sprintf(`document.querySelectorAll(%s).length`, jsString(submitSelector)),
+		&submitCount,
+	))
+
+	randomWait(config)
+
+	if config.HumanMouse && submitCount > 0 {
+		chromedp.Run(ctx, humanMouseMove(submitSelector))
+	}
+
+	if multipart {
+		if submitCount > 0 {
+			err := runAction(ctx, config, chromedp.Click(submitSelector))
+			if err != nil {
+				return nil, fmt.Errorf("could not click submit button: %v", err)
+			}
+			formResult.Method = "submit-button"
+		} else {
+			// requestSubmit runs validation and submit handlers like a click
+			err := runAction(ctx, config, chromedp.Evaluate(
+				fmt.Sprintf(`document.querySelector(%s).requestSubmit()`, jsString(formSel)),
+				nil,
+			))
+			if err != nil {
+				return nil, fmt.Errorf("could not submit multipart form: %v", err)
+			}
+			formResult.Method = "request-submit"
+		}
+		fmt.Fprintln(os.Stderr, "Multipart form submitted")
+
+		// Give the submission a moment to start navigating
+		time.Sleep(500 * time.Millisecond)
+	} else if isLiveView {
+		// For LiveView, submit by pressing Enter
+		fmt.Fprintln(os.Stderr, "Waiting for Phoenix LiveView navigation...")
+		err := runAction(ctx, config, chromedp.SendKeys(formSel, "\r"))
+		if err != nil {
+			return nil, fmt.Errorf("could not submit LiveView form: %v", err)
+		}
+		formResult.Method = "enter"
 
+		// Wait for LiveView to process
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprintln(os.Stderr, "LiveView form submitted")
+	} else {
+		// For regular forms, try submit button first, then Enter
+		var err error
 		if submitCount > 0 {
-			err = chromedp.Run(ctx, chromedp.Click(submitSelector))
+			err = runAction(ctx, config, chromedp.Click(submitSelector))
+			if err != nil {
+				return nil, fmt.Errorf("could not click submit button: %v", err)
+			}
+			formResult.Method = "submit-button"
+		} else {
+			err = runAction(ctx, config, chromedp.SendKeys(formSel, "\r"))
 			if err != nil {
-				return fmt.Errorf("could not click submit button: %v", err)
+				return nil, fmt.Errorf("could not submit form: %v", err)
+			}
+			formResult.Method = "enter"
+		}
+		fmt.Fprintln(os.Stderr, "Form submitted")
+
+		// Give the submission a moment to start navigating
+		time.Sleep(500 * time.Millisecond)
+	}
+	formResult.Submitted = true
+
+	chromedp.Run(ctx, chromedp.Location(&formResult.ToURL))
+	formResult.Navigated = formResult.ToURL != formResult.FromURL
+	if formResult.Navigated && !isLiveView {
+		if err := chromedp.Run(ctx, chromedp.WaitReady("body")); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Page load after submit timed out: %v\n", err)
+		}
+	}
+
+	// Look for validation or error messages left on the page
+	if err := chromedp.Run(ctx, chromedp.Evaluate(FORM_ERRORS_JS, &formResult.Errors)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not check for form errors: %v\n", err)
+	}
+
+	if config.DetectLoginFailure {
+		detectLoginFailure(ctx, formResult)
+	}
+
+	if config.CaptureCookiesPath != "" {
+		cookiesAfter, err := getCookies(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not read cookies after submit: %v", err)
+		}
+		changed := changedCookies(cookiesBefore, cookiesAfter)
+		if err := writeCookies(config.CaptureCookiesPath, changed); err != nil {
+			return nil, fmt.Errorf("could not save cookies: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Saved %d new or changed cookies to %s\n", len(changed), config.CaptureCookiesPath)
+	}
+
+	return formResult, nil
+}
+
+// getCookies returns every cookie in the browser, not just the current page's
+func getCookies(ctx context.Context) ([]*network.Cookie, error) {
+	var cookies []*network.Cookie
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		cookies, err = storage.GetCookies().Do(ctx)
+		return err
+	}))
+	return cookies, err
+}
+
+// changedCookies returns the cookies in after that are new or whose value
+// differs from before, matching cookies by name, domain and path
+func changedCookies(before, after []*network.Cookie) []*network.Cookie {
+	previous := make(map[string]string)
+	for _, c := range before {
+		previous[c.Name+"\x00"+c.Domain+"\x00"+c.Path] = c.Value
+	}
+
+	changed := []*network.Cookie{}
+	for _, c := range after {
+		if value, ok := previous[c.Name+"\x00"+c.Domain+"\x00"+c.Path]; !ok || value != c.Value {
+			changed = append(changed, c)
+		}
+	}
+	return changed
+}
+
+// writeCookies saves cookies as a JSON array
+func writeCookies(path string, cookies []*network.Cookie) error {
+	data, err := json.MarshalIndent(cookies, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// readCookies loads a JSON array of cookies written by writeCookies
+func readCookies(path string) ([]*network.Cookie, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cookies []*network.Cookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON array of cookies: %v", path, err)
+	}
+	return cookies, nil
+}
+
+// cookieParams converts saved cookies back into cookies to set, dropping
+// those that expired before now. Session cookies stay session cookies
+func cookieParams(cookies []*network.Cookie, now time.Time) []*network.CookieParam {
+	var params []*network.CookieParam
+	for _, c := range cookies {
+		param := &network.CookieParam{
+			Name:         c.Name,
+			Value:        c.Value,
+			Domain:       c.Domain,
+			Path:         c.Path,
+			Secure:       c.Secure,
+			HTTPOnly:     c.HTTPOnly,
+			SameSite:     c.SameSite,
+			Priority:     c.Priority,
+			SourceScheme: c.SourceScheme,
+			SourcePort:   c.SourcePort,
+			PartitionKey: c.PartitionKey,
+		}
+		if !c.Session && c.Expires > 0 {
+			expires := time.Unix(0, int64(c.Expires*float64(time.Second)))
+			if expires.Before(now) {
+				continue
+			}
+			ts := cdp.TimeSinceEpoch(expires)
+			param.Expires = &ts
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+func parseArgs() Config {
+	config := Config{
+		TruncateAfter:   DEFAULT_TRUNCATE_AFTER,
+		WaitTimeout:     DEFAULT_WAIT_TIMEOUT,
+		ShadowDepth:     DEFAULT_SHADOW_DEPTH,
+		NetworkIdleMS:   DEFAULT_NETWORK_IDLE_MS,
+		Timeout:         DEFAULT_TIMEOUT,
+		Profile:         "default",
+		Dialog:          "accept",
+		ChromiumVersion: os.Getenv("SURF_CHROMIUM_VERSION"),
+		MaxBrowsers:     envInt("SURF_MAX_BROWSERS"),
+		CrawlDepth:      1,
+		SameOrigin:      true,
+		MaxPages:        50,
+		Concurrency:     1,
+	}
+
+	timeoutGiven := false
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch arg {
+		case "--help":
+			printHelp()
+			os.Exit(0)
+		case "--quickstart":
+			printQuickstart()
+			os.Exit(0)
+		case "--doctor", "--health-check":
+			config.Doctor = true
+		case "--chromium-version":
+			if i+1 < len(args) {
+				config.ChromiumVersion = args[i+1]
+				i++
+			}
+		case "--version":
+			config.ShowVersion = true
+		case "--reinstall-chromium":
+			config.ReinstallChromium = true
+		case "--dom-stats":
+			config.DOMStats = true
+		case "--http":
+			config.ForceHTTP = true
+		case "--content-metrics":
+			config.ContentMetrics = true
+		case "--no-flush":
+			config.NoFlush = true
+		case "--security-report":
+			config.SecurityReport = true
+		case "--minify-html":
+			config.MinifyHTML = true
+		case "--strip-scripts":
+			config.StripScripts = true
+		case "--pretty-print-json":
+			config.PrettyPrintJSON = true
+		case "--raw":
+			config.RawFlag = true
+		case "--json":
+			config.JSONOutput = true
+		case "--jsonl":
+			config.JSONOutput = true
+			config.JSONLines = true
+		case "--template":
+			if i+1 < len(args) {
+				config.Template = args[i+1]
+				i++
+			}
+		case "--truncate-after":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val > 0 {
+					config.TruncateAfter = val
+				}
+				i++
+			}
+		case "--screenshot":
+			if i+1 < len(args) {
+				config.ScreenshotPath = args[i+1]
+				i++
+			}
+		case "--form":
+			if i+1 < len(args) {
+				config.FormID = args[i+1]
+				i++
+			}
+		case "--input":
+			if i+1 < len(args) {
+				name := args[i+1]
+				i++
+				if i+1 < len(args) && args[i+1] == "--value" {
+					i++
+					if i+1 < len(args) {
+						value := args[i+1]
+						config.Inputs = append(config.Inputs, FormInput{Name: name, Value: value})
+						i++
+					}
+				}
+			}
+		case "--value":
+			// Skip, handled with --input
+		case "--after-submit":
+			if i+1 < len(args) {
+				config.AfterSubmitURL = args[i+1]
+				i++
+			}
+		case "--js":
+			if i+1 < len(args) {
+				config.JSCode = append(config.JSCode, args[i+1])
+				i++
+			}
+		case "--click":
+			if i+1 < len(args) {
+				config.Clicks = append(config.Clicks, args[i+1])
+				i++
+			}
+		case "--js-in":
+			if i+1 < len(args) {
+				config.JSScope = args[i+1]
+				i++
+			}
+		case "--init-js":
+			if i+1 < len(args) {
+				config.InitScripts = append(config.InitScripts, args[i+1])
+				i++
+			}
+		case "--proxy":
+			if i+1 < len(args) {
+				if err := validateProxy(args[i+1]); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --proxy: %v\n", err)
+					os.Exit(1)
+				}
+				config.Proxy = args[i+1]
+				i++
+			}
+		case "--proxy-auth":
+			if i+1 < len(args) {
+				config.ProxyAuth = args[i+1]
+				i++
+			}
+		case "--proxy-list":
+			if i+1 < len(args) {
+				proxies, err := parseProxyList(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --proxy-list: %v\n", err)
+					os.Exit(1)
+				}
+				config.ProxyList = proxies
+				i++
+			}
+		case "--init-js-file":
+			if i+1 < len(args) {
+				data, err := os.ReadFile(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error reading --init-js-file: %v\n", err)
+					os.Exit(1)
+				}
+				config.InitScripts = append(config.InitScripts, string(data))
+				i++
+			}
+		case "--freeze-time":
+			if i+1 < len(args) {
+				frozen, err := parseFreezeTime(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --freeze-time: %v\n", err)
+					os.Exit(1)
+				}
+				config.FreezeTime = frozen
+				i++
+			}
+		case "--profile":
+			if i+1 < len(args) {
+				config.Profile = args[i+1]
+				i++
+			}
+		case "--retry-user-agents":
+			if i+1 < len(args) {
+				config.RetryUserAgents = parseUserAgents(args[i+1])
+				i++
+			}
+		case "--fallback-headful":
+			config.FallbackHeadful = true
+		case "--legacy-headless":
+			config.LegacyHeadless = true
+		case "--headful":
+			config.Headful = true
+		case "--window-size":
+			if i+1 < len(args) {
+				config.WindowSize = args[i+1]
+				i++
+			}
+		case "--viewport":
+			if i+1 < len(args) {
+				config.Viewport = args[i+1]
+				i++
+			}
+		case "--dpr":
+			if i+1 < len(args) {
+				val, err := strconv.ParseFloat(args[i+1], 64)
+				if err != nil || val <= 0 || val > 5 {
+					fmt.Fprintf(os.Stderr, "Error: --dpr must be a device pixel ratio between 0 and 5\n")
+					os.Exit(1)
+				}
+				config.DeviceScale = val
+				i++
+			}
+		case "--retina":
+			config.DeviceScale = 2
+		case "--dark-mode":
+			config.DarkMode = true
+		case "--emulate-device":
+			if i+1 < len(args) {
+				config.EmulateDevice = args[i+1]
+				i++
+			}
+		case "--session":
+			if i+1 < len(args) {
+				config.Session = args[i+1]
+				i++
+			}
+		case "--download-dir":
+			if i+1 < len(args) {
+				config.DownloadDir = args[i+1]
+				i++
+			}
+		case "--wait-for-download":
+			config.WaitForDownload = true
+		case "--retry-on-js-error":
+			config.RetryOnJSError = true
+		case "--tab-title":
+			if i+1 < len(args) {
+				config.TabTitle = args[i+1]
+				i++
+			}
+		case "--stop":
+			config.StopSession = true
+		case "--list-sessions":
+			config.ListSessions = true
+		case "--stop-all":
+			config.StopAll = true
+		case "--console-buffer":
+			config.ConsoleBuffer = true
+		case "--shadow-dom":
+			config.ShadowDOM = true
+		case "--shadow-depth":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err != nil || val <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: --shadow-depth must be a positive number of levels\n")
+					os.Exit(1)
+				}
+				config.ShadowDepth = val
+				config.ShadowDOM = true
+				i++
+			}
+		case "--exec-after":
+			if i+1 < len(args) {
+				config.ExecAfter = args[i+1]
+				i++
+			}
+		case "--save-session":
+			if i+1 < len(args) {
+				config.SaveSession = args[i+1]
+				i++
+			}
+		case "--stealth":
+			config.Stealth = true
+		case "--locale":
+			if i+1 < len(args) {
+				config.Locale = args[i+1]
+				i++
+			}
+		case "--accept-language":
+			if i+1 < len(args) {
+				config.AcceptLanguage = args[i+1]
+				i++
+			}
+		case "--timezone":
+			if i+1 < len(args) {
+				config.Timezone = args[i+1]
+				i++
+			}
+		case "--user-agent":
+			if i+1 < len(args) {
+				config.UserAgent = args[i+1]
+				i++
+			}
+		case "--human":
+			config.Human = true
+		case "--input-delay":
+			if i+1 < len(args) {
+				minMs, maxMs, err := parseDelayRange("--input-delay", args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				config.InputDelayMin, config.InputDelayMax = minMs, maxMs
+				i++
+			}
+		case "--human-mouse":
+			config.HumanMouse = true
+		case "--random-hardware":
+			config.RandomHardware = true
+		case "--ublock":
+			config.UBlock = true
+		case "--wait-random":
+			if i+1 < len(args) {
+				minMs, maxMs, err := parseDelayRange("--wait-random", args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				config.WaitRandomMin, config.WaitRandomMax = minMs, maxMs
+				i++
+			}
+		case "--output":
+			if i+1 < len(args) {
+				config.OutputPath = args[i+1]
+				i++
+			}
+		case "--element-text":
+			if i+1 < len(args) {
+				config.ElementText = args[i+1]
+				i++
+			}
+		case "--attribute":
+			if i+1 < len(args) {
+				config.Attributes = append(config.Attributes, args[i+1])
+				i++
+			}
+		case "--extract-attr":
+			if i+2 >= len(args) {
+				fmt.Fprintf(os.Stderr, "Error: --extract-attr takes a selector and an attribute name (e.g. --extract-attr a href)\n")
+				os.Exit(1)
+			}
+			config.ExtractAttrSelector = args[i+1]
+			config.ExtractAttrName = args[i+2]
+			i += 2
+		case "--extract":
+			if i+1 < len(args) {
+				config.Extract = append(config.Extract, args[i+1])
+				i++
+			}
+		case "--count":
+			if i+1 < len(args) {
+				config.CountSelector = args[i+1]
+				i++
+			}
+		case "--fail-on-error":
+			config.FailOnError = true
+		case "--fail-on-zero":
+			config.FailOnZero = true
+		case "--images", "--extract-images":
+			config.ExtractImages = true
+		case "--iframe":
+			if i+1 < len(args) {
+				config.IFrame = args[i+1]
+				i++
+			}
+		case "--pdf":
+			if i+1 < len(args) {
+				config.PDFPath = args[i+1]
+				i++
+			}
+		case "--pdf-landscape":
+			config.PDFLandscape = true
+		case "--screenshot-padding":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err != nil || val < 0 {
+					fmt.Fprintf(os.Stderr, "Error: --screenshot-padding must be a non-negative number of pixels\n")
+					os.Exit(1)
+				}
+				config.ScreenshotPadding = val
+				i++
+			}
+		case "--screenshot-selector":
+			if i+1 < len(args) {
+				config.ScreenshotSelector = args[i+1]
+				i++
+			}
+		case "--stitch":
+			config.ScreenshotStitch = true
+		case "--screenshot-full-page":
+			config.ScreenshotFullPage = true
+		case "--screenshot-baseline":
+			if i+1 < len(args) {
+				config.ScreenshotBaseline = args[i+1]
+				i++
 			}
-		} else {
-			err = chromedp.Run(ctx, chromedp.SendKeys(formSelector, "\r"))
-			if err != nil {
-				return fmt.Errorf("could not submit form: %v", err)
+		case "--screenshot-threshold":
+			if i+1 < len(args) {
+				val, err := strconv.ParseFloat(args[i+1], 64)
+				if err == nil && val >= 0 {
+					config.ScreenshotThreshold = val
+				}
+				i++
 			}
-		}
-		fmt.Println("Form submitted")
-	}
-
-	return nil
-}
-
-func parseArgs() Config {
-	config := Config{
-		TruncateAfter: DEFAULT_TRUNCATE_AFTER,
-		Profile:       "default",
-	}
-
-	args := os.Args[1:]
-	for i := 0; i < len(args); i++ {
-		arg := args[i]
-
-		switch arg {
-		case "--help":
-			printHelp()
-			os.Exit(0)
-		case "--quickstart":
-			printQuickstart()
-			os.Exit(0)
-		case "--raw":
-			config.RawFlag = true
-		case "--truncate-after":
+		case "--banner":
+			if i+1 < len(args) {
+				config.Banner = args[i+1]
+				i++
+			}
+		case "--follow-canonical":
+			config.FollowCanonical = true
+		case "--requests":
+			config.Requests = true
+		case "--har":
+			if i+1 < len(args) {
+				config.HARPath = args[i+1]
+				i++
+			}
+		case "--dump-storage":
+			config.DumpStorage = true
+		case "--links":
+			config.Links = true
+		case "--max-links":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err != nil || val <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: --max-links must be a positive number\n")
+					os.Exit(1)
+				}
+				config.MaxLinks = val
+				config.Links = true
+				i++
+			}
+		case "--requests-sort":
+			if i+1 < len(args) {
+				config.RequestsSort = args[i+1]
+				i++
+			}
+		case "--header":
+			if i+1 < len(args) {
+				config.Headers = append(config.Headers, args[i+1])
+				i++
+			}
+		case "--local-storage":
+			if i+1 < len(args) {
+				config.LocalStorage = append(config.LocalStorage, args[i+1])
+				i++
+			}
+		case "--cookies-in":
+			if i+1 < len(args) {
+				config.CookiesIn = args[i+1]
+				i++
+			}
+		case "--cookies-out":
+			if i+1 < len(args) {
+				config.CookiesOut = args[i+1]
+				i++
+			}
+		case "--cookie":
+			if i+1 < len(args) {
+				config.Cookies = append(config.Cookies, args[i+1])
+				i++
+			}
+		case "--block-resources":
+			if i+1 < len(args) {
+				config.BlockResources = args[i+1]
+				i++
+			}
+		case "--header-for":
+			if i+1 < len(args) {
+				config.HeaderFor = append(config.HeaderFor, args[i+1])
+				i++
+			}
+		case "--console-output":
+			if i+1 < len(args) {
+				config.ConsoleOutputPath = args[i+1]
+				i++
+			}
+		case "--output-append":
+			config.OutputAppend = true
+		case "--max-browsers":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val >= 0 {
+					config.MaxBrowsers = val
+				}
+				i++
+			}
+		case "--crawl":
+			config.Crawl = true
+		case "--depth":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val >= 0 {
+					config.CrawlDepth = val
+				}
+				i++
+			}
+		case "--same-origin":
+			config.SameOrigin = true
+		case "--cross-origin":
+			config.SameOrigin = false
+		case "--max-pages":
 			if i+1 < len(args) {
 				val, err := strconv.Atoi(args[i+1])
 				if err == nil && val > 0 {
-					config.TruncateAfter = val
+					config.MaxPages = val
 				}
 				i++
 			}
-		case "--screenshot":
+		case "--timeout":
 			if i+1 < len(args) {
-				config.ScreenshotPath = args[i+1]
+				val, err := strconv.Atoi(args[i+1])
+				if err != nil || val <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: --timeout must be a positive number of seconds\n")
+					os.Exit(1)
+				}
+				config.Timeout = val
+				timeoutGiven = true
 				i++
 			}
-		case "--form":
+		case "--wait-for-manual":
 			if i+1 < len(args) {
-				config.FormID = args[i+1]
+				config.WaitForManual = args[i+1]
 				i++
 			}
-		case "--input":
+		case "--wait-for":
 			if i+1 < len(args) {
-				name := args[i+1]
+				config.WaitFor = args[i+1]
 				i++
-				if i+1 < len(args) && args[i+1] == "--value" {
-					i++
-					if i+1 < len(args) {
-						value := args[i+1]
-						config.Inputs = append(config.Inputs, FormInput{Name: name, Value: value})
-						i++
-					}
+			}
+		case "--wait-for-any":
+			if i+1 < len(args) {
+				config.WaitForAny = splitSelectorList(args[i+1])
+				i++
+			}
+		case "--save-images":
+			if i+1 < len(args) {
+				config.SaveImagesDir = args[i+1]
+				i++
+			}
+		case "--trace-navigation":
+			config.TraceNavigation = true
+		case "--scroll":
+			config.Scroll = true
+		case "--wait-network-idle":
+			config.WaitNetworkIdle = true
+		case "--wait-for-idle":
+			config.WaitForIdle = true
+			config.WaitNetworkIdle = true
+		case "--network-idle-ms":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err != nil || val <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: --network-idle-ms must be a positive number of milliseconds\n")
+					os.Exit(1)
 				}
+				config.NetworkIdleMS = val
+				config.WaitNetworkIdle = true
+				i++
 			}
-		case "--value":
-			// Skip, handled with --input
-		case "--after-submit":
+		case "--wait-timeout":
 			if i+1 < len(args) {
-				config.AfterSubmitURL = ensureProtocol(args[i+1])
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val > 0 {
+					config.WaitTimeout = val
+				}
 				i++
 			}
-		case "--js":
+		case "--delay":
 			if i+1 < len(args) {
-				config.JSCode = args[i+1]
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val >= 0 {
+					config.Delay = val
+				}
 				i++
 			}
-		case "--profile":
+		case "--concurrency":
 			if i+1 < len(args) {
-				config.Profile = args[i+1]
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val > 0 {
+					config.Concurrency = val
+				}
 				i++
 			}
-		case "--headful":
-			config.Headful = true
-		case "--window-size":
+		case "--capture-cookies":
 			if i+1 < len(args) {
-				config.WindowSize = args[i+1]
+				config.CaptureCookiesPath = args[i+1]
 				i++
 			}
-		case "--session":
+		case "--detect-login-failure":
+			config.DetectLoginFailure = true
+		case "--no-submit":
+			config.NoSubmit = true
+		case "--retry":
 			if i+1 < len(args) {
-				config.Session = args[i+1]
+				val, err := strconv.Atoi(args[i+1])
+				if err != nil || val < 0 {
+					fmt.Fprintf(os.Stderr, "Error: --retry must be a non-negative number of attempts\n")
+					os.Exit(1)
+				}
+				config.Retry = val
+				i++
+			}
+		case "--action-retries":
+			if i+1 < len(args) {
+				val, err := strconv.Atoi(args[i+1])
+				if err == nil && val >= 0 {
+					config.ActionRetries = val
+				}
+				i++
+			}
+		case "--dialog":
+			if i+1 < len(args) {
+				config.Dialog = args[i+1]
 				i++
 			}
-		case "--stop":
-			config.StopSession = true
-		case "--stealth":
-			config.Stealth = true
-		case "--ublock":
-			config.UBlock = true
 		default:
 			if config.URL == "" && !strings.HasPrefix(arg, "--") {
 				config.URL = arg
@@ -1191,6 +7709,39 @@ func parseArgs() Config {
 		}
 	}
 
+	// --http only changes bare hosts; an explicit https:// is respected
+	if config.ForceHTTP && config.URL != "" && !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+		config.URL = "http://" + config.URL
+	}
+
+	// The device's size and user agent are defaults that --viewport, --dpr
+	// and --user-agent still override; --human then fills in the rest
+	if config.EmulateDevice != "" {
+		device, ok := DEVICES[config.EmulateDevice]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown --emulate-device %q (choose from: %s)\n", config.EmulateDevice, strings.Join(deviceNames(), ", "))
+			os.Exit(1)
+		}
+		applyDevice(&config, device)
+	}
+
+	if config.Human {
+		applyHumanPreset(&config)
+	}
+	if config.RandomHardware {
+		config.InitScripts = append([]string{randomHardwareScript()}, config.InitScripts...)
+	}
+
+	// Solving a challenge by hand takes longer than a page load
+	if config.WaitForManual != "" && !timeoutGiven {
+		config.Timeout = MANUAL_WAIT_TIMEOUT
+	}
+
+	// The time freeze must run before any other init script
+	if !config.FreezeTime.IsZero() {
+		config.InitScripts = append([]string{freezeTimeJS(config.FreezeTime)}, config.InitScripts...)
+	}
+
 	return config
 }
 
@@ -1202,21 +7753,202 @@ Usage: surf <url> [options]
 Options:
   --help                     Show this help message
   --quickstart               Show detailed usage guide for AI agents
+  --doctor, --health-check   Check the Chromium install, architecture, launch and ~/.surf access
+  --reinstall-chromium       Delete the downloaded Chromium and download a fresh copy
+  --chromium-version <rev>   Use a specific Chromium snapshot revision (env: SURF_CHROMIUM_VERSION)
+  --version                  Show the installed Chromium revision
+  --http                     Use http:// instead of https:// for a URL given without a protocol
   --raw                      Output raw page instead of converting to markdown
+  --banner <style>           Header and section style: box (default), markdown (# URL, ## sections)
+                             or none, for embedding output in other markdown
+  --json                     Print a JSON object (url, final_url, title, status, markdown or raw_html,
+                             console, truncated, ...) instead of the text layout
+  --jsonl                    Like --json, but one object per line; with --crawl, a line per page as
+                             it finishes (failed pages get an "error" field)
+  --exec-after <command>     Run <command> with the shell after extraction, with the result on its stdin
+                             and SURF_URL / SURF_STATUS set; its output replaces the result on stdout
+                             and surf exits with its exit code if it fails (e.g. --exec-after "jq .")
+  --template <go-template>   Render the same fields with a Go template ({{.FinalURL}}, {{.Status}},
+                             {{.Markdown}}, {{range .Console}}...); json and csv helper functions
+  --pretty-print-json        Indent JSON responses instead of converting them; truncation keeps the JSON valid
+  --minify-html              With --raw, strip comments and collapse whitespace
+  --strip-scripts            With --minify-html, also drop <script> and <style> contents
+  --shadow-dom               Include the content of open shadow roots (web components) in the output
+  --shadow-depth <n>         How many levels of nested shadow roots --shadow-dom follows (default: 10);
+                             deeper content is replaced by a note. Implies --shadow-dom
+  --dom-stats                Report element count, depth, iframes, shadow roots, scripts and HTML size
+  --content-metrics          Report HTML size, markdown size, estimated tokens and whether output was truncated
+  --security-report          Report security state, certificate, mixed-content requests and the redirect chain
+  --requests                 List every request the page made: method, status, type, size and time
+  --requests-sort <key>      With --requests, list the largest ('size') or slowest ('duration') first
+  --har <path>               Write every request and response (headers, status, timings) to <path> as a
+                             HAR 1.2 file, for browser devtools or HAR viewers
+  --links                    List the page's links as absolute URLs, de-duplicated, in a LINKS section
+                             (a links array with --json)
+  --max-links <n>            List at most <n> links. Implies --links
+  --dump-storage             List the page's localStorage and sessionStorage once it settles, in a
+                             STORAGE section (a storage object with --json)
+  --follow-canonical         If the page's <link rel=canonical> names another URL, load and output that
+                             instead (up to 3 hops); both URLs are reported
+  --iframe <css|name>        Output the content of a same-origin iframe, found by selector, name or id
+  --element-text <css>       Print only the trimmed text of the first element matching <css>
+  --attribute <css>@<attr>   Print an attribute of the first element matching <css> (repeatable;
+                             several are printed as a JSON object)
+  --extract-attr <css> <attr>
+                             Print <attr> of every element matching <css>, one per line (a JSON
+                             array with --json), e.g. --extract-attr a href
+  --extract <css>            Convert only the elements matching <css> instead of the whole page
+                             (repeatable; matches are kept in flag order)
+  --count <css>              Print how many elements match <css>
+  --fail-on-error            Exit with status 2 when the page returned an HTTP status of 400 or above
+                             (the page is still printed; error statuses are always shown in the header,
+                             successful ones only in --json)
+  --fail-on-zero             With --count, exit with status 2 when nothing matches
+  --images, --extract-images Print every image's absolute URL and alt text as JSON (uses the largest
+                             srcset candidate and lazy-load data-src/data-srcset attributes)
+  --save-images <dir>        Download the page's images (including lazy-loaded and srcset ones) into <dir>,
+                             using the browser's cookies and proxy, and link them in the markdown as ![alt](<dir>/file)
   --truncate-after <number>  Truncate output after <number> characters and append a notice (default: %d)
-  --screenshot <filepath>    Take a screenshot of the page and save it to the given filepath
-  --form <id>                The id of the form for inputs
-  --input <name>             Specify the name attribute for a form input field
-  --value <value>            Provide the value to fill for the last --input field
+  --screenshot <filepath>    Take a screenshot of the visible viewport and save it to the given filepath
+  --screenshot-full-page     With --screenshot, capture the entire scrollable page instead
+  --screenshot-selector <css>
+                             With --screenshot, capture only the first element matching <css>
+  --screenshot-padding <px>  With --screenshot-selector, include <px> of surrounding page on every side
+  --stitch                   With --screenshot, capture the whole page by scrolling and stitching
+                             viewport slices; for pages too tall for --screenshot-full-page
+  --pdf <path>               Save the page as a paginated PDF after it (and any --js) has settled;
+                             with --window-size the paper matches the window
+  --pdf-landscape            With --pdf, print in landscape orientation
+  --screenshot-baseline <path>
+                             Compare the screenshot to a baseline PNG (created if missing) and write
+                             a <screenshot>-diff.png highlighting changed pixels
+  --screenshot-threshold <pct>
+                             With --screenshot-baseline, exit with status 2 when more than <pct>
+                             percent of pixels changed (default: 0)
+  --output <path>            Write the result to <path> instead of stdout
+  --output-append            Append to the --output file instead of overwriting it
+  --console-output <path>    Also write console messages (level, text, timestamp, source) as JSON to <path>
+  --form <selector>          The form for inputs: a CSS selector such as "form.login" or
+                             "form[name=login]", or a bare word taken as the form's id
+  --input <name>             Specify the name attribute for a form input or textarea, or a CSS selector
+                             for a contenteditable region (e.g. "#comment .editor")
+  --value <value>            Provide the value to fill for the last --input field. For a <select>, the
+                             option's value or text; for a checkbox, true/false (or the box's value in a
+                             group); for radios, the value of the one to pick
   --after-submit <url>       After form submission and navigation, load this URL before converting to markdown
-  --js <code>                Execute JavaScript code on the page after it loads
+                             Relative paths (/dashboard, ../next) resolve against the current page
+  --no-submit                Fill the --form inputs but don't submit, e.g. to --screenshot or --js the
+                             filled form
+  --timeout <seconds>        Give up on a page after <seconds> (default: 60; per page when crawling)
+  --wait-for <css>           Wait until an element matching <css> is visible before continuing
+  --wait-for-manual <css|url>
+                             With --headful, pause until a person clears a CAPTCHA or challenge: until
+                             <css> exists or the page reaches <url> (/path or absolute); the timeout
+                             becomes 10 minutes unless --timeout is given
+  --trace-navigation         List every URL and title the page went through during the run, including
+                             SPA route changes without a full page load, in a NAVIGATION section
+  --scroll                   Scroll to the bottom of the page step by step before extracting, so
+                             lazy-loaded images and infinite-scroll items are included (up to 30 steps)
+  --wait-network-idle        After load, wait until no requests have been in flight for a quiet window,
+                             so XHR/fetch content of JS apps is included (gives up after --wait-timeout)
+  --wait-for-idle            Like --wait-network-idle, but the DOM must also have stopped changing for
+                             the same quiet window; for apps that keep rendering after their data arrives
+  --network-idle-ms <ms>     Quiet window for --wait-network-idle and --wait-for-idle (default: 500).
+                             Implies --wait-network-idle
+  --wait-for-any <css,...>   After --form and --js, wait until any of the comma-separated selectors is
+                             visible and report which one matched (e.g. ".success,.error")
+  --wait-timeout <ms>        How long --wait-for and --wait-for-any wait before failing (default: 10000)
+  --click <css>              Click the first element matching <css> once visible, then wait for any
+                             navigation like --js does; repeatable, runs in order before --js steps
+  --js <code>                Execute JavaScript code on the page after it loads (repeatable; steps run
+                             in order and the last one's return value is reported)
+  --js-in <css>              Run --js with this/el bound to the first element matching <css>, and
+                             root bound to its shadow root or iframe document
+  --download-dir <path>      Save files downloaded by the page, form or --js into <path>
+  --wait-for-download        With --download-dir, wait for a download to finish and report its path
+  --header "<Key>: <Value>"  Send a header with every request (repeatable; see --header-for to limit it)
+  --cookie <name=value>      Set a cookie for the target URL before loading it (repeatable)
+  --cookies-out <path>       After the page (and any --form or --js) is done, save every cookie as JSON
+  --cookies-in <path>        Load cookies saved by --cookies-out (or --capture-cookies) before navigating,
+                             e.g. to reuse a login on another machine without copying the profile
+  --local-storage <key=value>
+                             Set a localStorage item in the page's origin once it loads, then reload
+                             so the app reads it, e.g. a feature flag or auth token (repeatable)
+  --header-for <pattern>:<Key>:<Value>
+                             Send a header only on requests whose URL matches <pattern> (* and ?
+                             wildcards, e.g. "api.example.com/*:Authorization:Bearer x"; repeatable)
+  --block-resources <types>  Abort requests of these comma-separated types to load text-only pages faster:
+                             image, media, font, stylesheet, script (e.g. image,font,stylesheet,media)
+  --init-js <code>           Run JavaScript in every new document before page scripts (repeatable)
+  --init-js-file <path>      Like --init-js, reading the script from a file (repeatable)
+  --freeze-time <iso8601>    Pin Date to the given time and make Math.random deterministic
   --profile <name>           Use or create named session profile (default: "default")
+  --no-flush                 Skip the profile flush on exit; faster, but storage changes may be lost
   --headful                  Run browser in visible window mode (not headless)
+  --legacy-headless          Use Chromium's old headless mode instead of --headless=new (see below)
+  --user-agent <string>      Send this user agent instead of Chromium's (or --stealth's)
+  --locale <xx-YY>           Present the browser as this locale: navigator.language(s), Accept-Language,
+                             Intl number/date formatting, and the locale's usual timezone (e.g. de-DE)
+  --timezone <zone>          Use this IANA timezone (e.g. America/Chicago), overriding --locale's
+  --accept-language <list>   Send this Accept-Language header (e.g. "fr-FR,fr;q=0.9,en;q=0.8"), overriding
+                             --locale's; with --stealth, navigator.languages lists the same languages
+  --human                    Behave more like a person; shorthand for --stealth, a random Chrome user
+                             agent, --random-hardware, a common --window-size/--viewport, --wait-random
+                             300,1200, --input-delay 40,160 and --human-mouse
+  --input-delay <min,max>    Type form values one key at a time, pausing a random min-max milliseconds
+                             after each key
+  --human-mouse              Move the pointer onto an element in small eased steps before clicking it
+                             (--click targets, submit buttons and contenteditable fields)
+  --random-hardware          Report a random navigator.hardwareConcurrency (4, 8, 12 or 16) and
+                             navigator.deviceMemory (4 or 8) instead of the host's
+  --fallback-headful         If a headless run hits a bot wall or blank page, retry it headful
+  --retry-user-agents <list> If the page looks blocked, retry with each user agent in the comma-separated
+                             <list> (or "pool" for a built-in set) until one gets through
+  --retry-on-js-error        Reload once if the page throws during load and renders almost no text
   --window-size <WxH>        Set browser window size (e.g., 1280x720), useful with --headful
+  --viewport <WxH>           Set the page layout viewport (e.g., 1440x900), independent of --window-size
+                             Affects media queries and screenshot width; in headless mode there is no
+                             real window, so --viewport is the reliable way to control page layout
+  --dpr <n>                  Set the device pixel ratio (e.g., 2); screenshots are n times the
+                             viewport in each dimension
+  --retina                   Shorthand for --dpr 2
+  --emulate-device <name>    Present the page as a phone or tablet: viewport, pixel ratio, mobile layout,
+                             touch events and user agent (iphone-13, iphone-se, pixel-7, galaxy-s8,
+                             ipad-air); --viewport, --dpr and --user-agent override its values
+  --dark-mode                Emulate prefers-color-scheme: dark, so sites render their dark theme
+                             (also in --screenshot and --pdf)
   --session <id>             Use persistent browser session (stays open between calls)
                              With an active session, URL is optional if using --js or --screenshot
+  --console-buffer           With --session, show the console output the tab collected across surf runs
+                             (last 1000 messages) instead of only this run's
   --stop                     Stop a persistent session (requires --session)
+  --stop-all                 Stop every running session and remove stale session files
+  --list-sessions            List saved sessions with their profile, PID, and whether the browser is
+                             still running; dead ones are flagged as stale
+  --tab-title <text>         Use the session tab whose title or URL contains <text> (requires --session)
+  --save-session <id>        Run one-shot, then keep the browser open as session <id> instead of closing it
   --stealth                  Enable anti-detection mode (realistic user-agent, hide automation)
+  --dialog <accept|dismiss>  How to respond to alert/confirm/prompt/beforeunload dialogs (default: accept)
+  --detect-login-failure     After --form submit, exit with status 2 if the login looks failed
+                             (error messages shown or password field still present; staying on the
+                             login URL alone is only reported, as single-page apps log in in place)
+  --capture-cookies <path>   After --form submit, save cookies the submission set or changed as JSON
+  --retry <n>                Retry a failed page load up to <n> times, waiting 1s, 2s, 4s... in between
+  --action-retries <n>       Retry failed form fill/submit steps up to <n> times (default: 0, fail fast)
+  --wait-random <min,max>    Sleep a random min-max milliseconds before each form fill, submit and --js step
+  --max-browsers <n>         Allow at most <n> surf browsers at once across processes; others wait
+                             (env: SURF_MAX_BROWSERS)
+  --crawl                    Crawl from the URL, following links and printing every page
+  --depth <n>                Link depth to follow when crawling (default: 1)
+  --same-origin              Only follow links on the seed's origin when crawling (default)
+  --cross-origin             Follow links to any origin when crawling
+  --max-pages <n>            Stop crawling after <n> pages (default: 50)
+  --delay <ms>               Wait <ms> milliseconds before each crawled page
+  --concurrency <n>          Number of pages to crawl in parallel tabs (default: 1)
+  --proxy <url>              Send all traffic through a proxy (host:port, http://, https:// or socks5://)
+  --proxy-auth <user:pass>   Credentials for --proxy or --proxy-list proxies (not supported for socks5)
+  --proxy-list <file|list>   Proxies (host:port, http://, socks5://) from a file or comma-separated list;
+                             crawled pages rotate through them, a single page uses the first
 
 Phoenix LiveView Support:
 This tool automatically detects Phoenix LiveView applications and properly handles:
@@ -1229,6 +7961,8 @@ Examples:
   surf https://example.com --screenshot page.png --truncate-after 5000
   surf https://example.com --headful --window-size 1920x1080
   surf localhost:4000/login --form login_form --input email --value test@example.com --input password --value secret
+  surf https://example.com --template '{{.Status}},{{csv .FinalURL}},{{csv .Title}}'
+  surf https://example.com --template '<page url="{{.FinalURL}}">{{"\n"}}{{.Markdown}}{{"\n"}}</page>'
 `, DEFAULT_TRUNCATE_AFTER)
 }
 
@@ -1240,12 +7974,19 @@ Fork of chrismccord/web.
 
 BASIC USAGE
   surf https://example.com          Convert page to markdown
-  surf example.com                  Protocol auto-added (http://)
+  surf example.com                  Protocol auto-added (https://, or http:// for
+                                    localhost, IPs and explicit ports)
+  surf example.com --http           Force plain http:// for a bare host
 
 OUTPUT MODES
   surf https://example.com          Markdown output (default, optimized for LLMs)
   surf https://example.com --raw    Raw HTML output
   surf url --truncate-after 5000    Limit output to 5000 chars
+  surf url --output page.md         Write result to a file instead of stdout
+  surf url --output corpus.md --output-append   Accumulate results across runs
+  surf url --json                   JSON object: url, final_url, title, status, markdown, console, ...
+  surf url --template '{{.Status}} {{.Title}}'  Custom output from the same fields (Go template;
+                                    json and csv helpers, e.g. {{csv .Title}}, {{json .Console}})
 
 SCREENSHOTS
   surf https://example.com --screenshot page.png
@@ -1253,8 +7994,19 @@ SCREENSHOTS
 
 JAVASCRIPT EXECUTION
   surf https://example.com --js "document.querySelector('button').click()"
+  surf https://example.com --click button --click "#confirm"
   surf https://example.com --js "console.log(document.title)"
   Console output (log/warn/error) is captured and appended to output.
+  JS dialogs (alert/confirm/beforeunload) are accepted automatically and logged as [DIALOG].
+  Use --dialog dismiss to cancel them instead.
+
+  Setup scripts that run before the page's own scripts (polyfills, mocks, stubs):
+  surf https://example.com --init-js "Math.random = () => 0.5" --init-js-file mocks.js
+  Init scripts run in order on every document loaded after they are registered;
+  --js runs once, after the page has loaded.
+
+  Reproducible captures (fixed Date.now() and seeded Math.random):
+  surf https://example.com --freeze-time 2024-01-15T10:30:00Z --screenshot snap.png
 
 FORM FILLING
   surf https://login.example.com \
@@ -1268,10 +8020,54 @@ FORM FILLING
       --input "email" --value "me@example.com" \
       --after-submit "https://example.com/dashboard"
 
+  Relative after-submit paths resolve against the page reached after submitting:
+      --after-submit "/dashboard"
+
+  Fill without submitting, then capture the filled form:
+  surf https://example.com/signup \
+      --form "signup" --input "email" --value "me@example.com" \
+      --no-submit --screenshot filled.png
+
+  A FORM RESULT section reports how the form was submitted, whether the page
+  navigated (from -> to URL) and any validation/error messages left on the page.
+  Add --detect-login-failure to exit with status 2 when a login looks failed
+  (error messages shown or a password field still rendered after submit).
+
 HEADFUL MODE (visible browser for debugging)
   surf https://example.com --headful
   surf https://example.com --headful --window-size 1920x1080
 
+VIEWPORT (layout size, independent of window)
+  surf https://example.com --viewport 1440x900 --screenshot wide.png
+  --window-size sizes the browser window; --viewport overrides the page's layout
+  viewport via device metrics emulation. Use --viewport for headless captures.
+
+MOBILE (phone and tablet layouts)
+  surf https://example.com --emulate-device iphone-13 --screenshot mobile.png
+  surf https://example.com --emulate-device pixel-7 --dpr 1
+  Unlike --window-size, this sets the mobile and touch flags sites check
+  before serving their mobile version, and a matching user agent.
+
+HIGH-DPI SCREENSHOTS (sharper text for OCR and vision models)
+  surf https://example.com --retina --screenshot crisp.png
+  surf https://example.com --dpr 3 --viewport 390x844 --screenshot phone.png
+  --dpr scales the rendering, not the layout: a 1280x720 viewport at --dpr 2
+  captures a 2560x1440 image, roughly three to four times the file size. The
+  layout width still comes from --viewport, or the window (--window-size).
+
+LEGACY HEADLESS (escape hatch when --headless=new misbehaves)
+  surf https://example.com --legacy-headless
+  The old headless mode is a separate, lighter browser implementation: it
+  reports "HeadlessChrome" in its user agent, has no extension support (so no
+  --ublock) and renders some pages differently. Chromium 132 and later removed
+  it, where the flag has no effect; pin an older revision with --chromium-version.
+
+CRAWLING (follow links from a seed URL)
+  surf https://docs.example.com --crawl --depth 2
+  surf https://docs.example.com --crawl --depth 3 --max-pages 100 --concurrency 4 --delay 250
+  Visits each unique URL once, same-origin only unless --cross-origin is given.
+  Every page is printed with its own ==== URL ==== banner.
+
 PERSISTENT SESSIONS (keep browser open between calls)
   surf https://example.com --session myapp            # Start session, fetch page
   surf https://example.com/page2 --session myapp      # Reuse same browser
@@ -1279,6 +8075,11 @@ PERSISTENT SESSIONS (keep browser open between calls)
   surf --session myapp --js "document.querySelector('button').click()"  # Run JS on current page (no URL needed)
   surf --session myapp --screenshot current.png       # Screenshot current page (no URL needed)
   surf --session myapp --stop                         # Close browser when done
+  surf --list-sessions                                # Show running and stale sessions
+
+  Promote a one-shot run (e.g. a login) to a session afterwards:
+  surf https://app.example.com/login --form login ... --save-session myapp
+  surf https://app.example.com/dashboard --session myapp
 
   Multiple sessions can run in parallel:
   surf https://site-a.com --session agent1 --headful
@@ -1303,15 +8104,27 @@ STEALTH MODE (anti-detection)
   - Disables automation-controlled blink features
   - Spoofs plugins, languages, and WebGL fingerprints
 
+  Add human-like timing jitter between interaction steps:
+  surf https://example.com --stealth --wait-random 200,800 --form login ...
+
+TROUBLESHOOTING
+  surf --doctor                     Check Chromium install, arch, launch and ~/.surf access
+  surf --reinstall-chromium         Force a fresh Chromium download (fixes corrupt installs)
+  surf --version                    Show the installed Chromium revision
+  surf url --chromium-version 1234567   Pin a Chromium snapshot revision (installed
+                                    side by side in ~/.surf/chromium-<rev>/)
+
 AGENT INTEGRATION TIPS
   - Output is markdown, optimized for LLM context windows
   - Console logs captured and appended (useful for debugging)
   - Use --truncate-after to limit output size for large pages
+  - Use --dom-stats to see why a page is slow or heavy to extract
   - Use --screenshot to verify visual state
   - Profiles persist auth across multiple surf calls
   - Combine --js with --screenshot to capture post-interaction state
   - Use --session for multi-step workflows (faster, maintains state)
   - Multiple agents can use separate --session IDs in parallel
+  - Set SURF_MAX_BROWSERS=4 on shared machines to cap concurrent Chrome instances
   - Use --stealth when scraping sites with bot detection
 
 EXAMPLES
@@ -1335,6 +8148,19 @@ EXAMPLES
 `)
 }
 
+// headlessMode picks the value for Chromium's --headless flag. "old" is the
+// classic headless implementation, an escape hatch for sites or revisions
+// where the new one misbehaves
+func headlessMode(config Config) string {
+	if config.LegacyHeadless {
+		return "old"
+	}
+	return "new"
+}
+
+// sizeRe matches a "<width>x<height>" size such as --viewport takes
+var sizeRe = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
 // parseWindowSize parses a window size string like "1280x720" into width and height
 func parseWindowSize(size string) (int, int) {
 	parts := strings.Split(size, "x")
@@ -1349,12 +8175,250 @@ func parseWindowSize(size string) (int, int) {
 	return width, height
 }
 
-// Ensure URL has protocol
+// envInt reads a non-negative integer from an environment variable, or 0
+func envInt(name string) int {
+	val, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || val < 0 {
+		return 0
+	}
+	return val
+}
+
+// parseFreezeTime parses an ISO 8601 timestamp or date for --freeze-time
+func parseFreezeTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid ISO 8601 time %q (e.g. 2024-01-15T10:30:00Z)", value)
+}
+
+// freezeTimeJS returns an init script pinning Date to the given time and
+// replacing Math.random with a PRNG seeded from it
+func freezeTimeJS(t time.Time) string {
+	return fmt.Sprintf(`
+(() => {
+    const FROZEN = %d;
+    const OrigDate = Date;
+    function FrozenDate(...args) {
+        if (!new.target) return new OrigDate(FROZEN).toString();
+        return args.length ? new OrigDate(...args) : new OrigDate(FROZEN);
+    }
+    FrozenDate.prototype = OrigDate.prototype;
+    FrozenDate.now = () => FROZEN;
+    FrozenDate.parse = OrigDate.parse;
+    FrozenDate.UTC = OrigDate.UTC;
+    Date = FrozenDate;
+
+    // mulberry32
+    let seed = FROZEN %% 4294967296;
+    Math.random = function() {
+        seed = (seed + 0x6D2B79F5) | 0;
+        let t = Math.imul(seed ^ (seed >>> 15), 1 | seed);
+        t = (t + Math.imul(t ^ (t >>> 7), 61 | t)) ^ t;
+        return ((t ^ (t >>> 14)) >>> 0) / 4294967296;
+    };
+})();
+`, t.UnixMilli())
+}
+
+// parseDelayRange parses the "min,max" millisecond range of --wait-random or
+// --input-delay; flag names the option in errors
+func parseDelayRange(flag, value string) (int, int, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%s must be <min,max> milliseconds, got %q", flag, value)
+	}
+	minMs, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	maxMs, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || minMs < 0 || maxMs < minMs {
+		return 0, 0, fmt.Errorf("%s must be <min,max> milliseconds with 0 <= min <= max, got %q", flag, value)
+	}
+	return minMs, maxMs, nil
+}
+
+// stripFragment removes the #fragment from a URL so page variants dedupe
+func stripFragment(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// isSameOrigin reports whether link has the same scheme and host as origin
+func isSameOrigin(origin *url.URL, link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == origin.Scheme && u.Host == origin.Host
+}
+
+// resolveAfterSubmitURL resolves path-relative targets (/path, ./path, ../path,
+// ?query) against the current page URL and adds a protocol to bare hosts
+func resolveAfterSubmitURL(target, currentURL string) string {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return target
+	}
+	if strings.HasPrefix(target, "/") || strings.HasPrefix(target, ".") || strings.HasPrefix(target, "?") {
+		base, err := url.Parse(currentURL)
+		if err != nil {
+			return target
+		}
+		ref, err := url.Parse(target)
+		if err != nil {
+			return target
+		}
+		return base.ResolveReference(ref).String()
+	}
+	return ensureProtocol(target)
+}
+
+// Ensure URL has protocol: https for bare hosts, http for localhost, IP
+// addresses and hosts with an explicit port where https is rarely served
 func ensureProtocol(url string) string {
-	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return url
+	}
+
+	host := url
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	hostname, _, err := net.SplitHostPort(host)
+	hasPort := err == nil
+	if !hasPort {
+		hostname = strings.Trim(host, "[]")
+	}
+
+	if hasPort || hostname == "localhost" || strings.HasSuffix(hostname, ".localhost") || net.ParseIP(hostname) != nil {
 		return "http://" + url
 	}
-	return url
+	return "https://" + url
+}
+
+var (
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+	whitespaceRe  = regexp.MustCompile(`\s+`)
+	// Elements whose contents are whitespace-sensitive or not HTML
+	rawTextRe     = regexp.MustCompile(`(?is)<pre\b[^>]*>.*?</pre\s*>|<textarea\b[^>]*>.*?</textarea\s*>|<script\b[^>]*>.*?</script\s*>|<style\b[^>]*>.*?</style\s*>`)
+	rawTextOpenRe = regexp.MustCompile(`(?is)^<(script|style)\b[^>]*>`)
+)
+
+// minifyHTML strips comments and collapses whitespace runs to one space,
+// leaving <pre>, <textarea>, <script> and <style> contents untouched. With
+// stripScripts, <script> and <style> elements keep their tags but lose
+// their bodies
+func minifyHTML(html string, stripScripts bool) string {
+	var out strings.Builder
+	compact := func(segment string) {
+		segment = htmlCommentRe.ReplaceAllString(segment, "")
+		out.WriteString(whitespaceRe.ReplaceAllString(segment, " "))
+	}
+
+	last := 0
+	for _, loc := range rawTextRe.FindAllStringIndex(html, -1) {
+		compact(html[last:loc[0]])
+		element := html[loc[0]:loc[1]]
+		if open := rawTextOpenRe.FindStringSubmatch(element); stripScripts && open != nil {
+			element = open[0] + "</" + strings.ToLower(open[1]) + ">"
+		}
+		out.WriteString(element)
+		last = loc[1]
+	}
+	compact(html[last:])
+
+	return strings.TrimSpace(out.String())
+}
+
+// jsonDocumentBody returns the body of a JSON response. Chromium wraps JSON
+// documents in a <pre>, next to its own viewer markup
+func jsonDocumentBody(ctx context.Context) (string, bool) {
+	var body *string
+	err := chromedp.Run(ctx, chromedp.Evaluate(`(() => {
+	if (!/[/+]json$/i.test(document.contentType)) return null;
+	const pre = document.querySelector('body > pre');
+	return pre ? pre.textContent : document.body.innerText;
+})()`, &body))
+	if err != nil || body == nil {
+		return "", false
+	}
+	return *body, true
+}
+
+// prettyJSON indents a JSON document by two spaces
+func prettyJSON(body string) (string, error) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(strings.TrimSpace(body)), "", "  "); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// cutAtRune returns s cut to at most n bytes, backing up so a multi-byte
+// character at the cut isn't split
+func cutAtRune(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// truncateJSON shortens indented JSON to at most about limit characters
+// while keeping it valid: it cuts after the last whole line that fits,
+// drops a dangling comma and closes every bracket still open
+func truncateJSON(pretty string, limit int) string {
+	lines := strings.Split(pretty, "\n")
+	var kept []string
+	size := 0
+	for _, line := range lines {
+		if size+len(line)+1 > limit && len(kept) > 0 {
+			break
+		}
+		kept = append(kept, line)
+		size += len(line) + 1
+	}
+
+	// Track the brackets left open by the kept lines, skipping strings
+	var open []byte
+	inString, escaped := false, false
+	for _, line := range kept {
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case escaped:
+				escaped = false
+			case inString && c == '\\':
+				escaped = true
+			case c == '"':
+				inString = !inString
+			case inString:
+			case c == '{' || c == '[':
+				open = append(open, c)
+			case c == '}' || c == ']':
+				if len(open) > 0 {
+					open = open[:len(open)-1]
+				}
+			}
+		}
+	}
+
+	last := len(kept) - 1
+	kept[last] = strings.TrimSuffix(kept[last], ",")
+	for i := len(open) - 1; i >= 0; i-- {
+		closer := "}"
+		if open[i] == '[' {
+			closer = "]"
+		}
+		kept = append(kept, strings.Repeat("  ", i)+closer)
+	}
+	return strings.Join(kept, "\n")
 }
 
 // Clean markdown
@@ -1379,3 +8443,74 @@ func cleanMarkdown(markdown string) string {
 
 	return strings.TrimSpace(strings.Join(lines, "\n"))
 }
+
+// botWallMarkers are phrases typical of anti-bot interstitials
+var botWallMarkers = []string{
+	"just a moment",
+	"attention required",
+	"access denied",
+	"verify you are human",
+	"are you a robot",
+	"captcha",
+	"unusual traffic",
+	"enable javascript and cookies",
+	"checking your browser",
+	"request unsuccessful",
+}
+
+// retriesOnBlock reports whether a blocked page should be retried, with
+// another user agent or headful. Only one-shot runs can be relaunched
+func retriesOnBlock(config Config) bool {
+	if config.Session != "" || config.SaveSession != "" {
+		return false
+	}
+	return (config.FallbackHeadful && !config.Headful) || len(config.RetryUserAgents) > 0
+}
+
+var userAgentStartRe = regexp.MustCompile(`^[A-Za-z][\w.-]*/\S`)
+
+// parseUserAgents splits a --retry-user-agents list. User agents contain
+// commas themselves ("KHTML, like Gecko"), so a comma only starts a new entry
+// when the text after it begins with a product token such as Mozilla/5.0.
+// "pool" selects the built-in list
+func parseUserAgents(list string) []string {
+	if strings.TrimSpace(list) == "pool" {
+		return RETRY_USER_AGENT_POOL
+	}
+
+	var agents []string
+	for _, part := range strings.Split(list, ",") {
+		trimmed := strings.TrimSpace(part)
+		if len(agents) > 0 && !userAgentStartRe.MatchString(trimmed) {
+			agents[len(agents)-1] += "," + part
+			continue
+		}
+		if trimmed != "" {
+			agents = append(agents, trimmed)
+		}
+	}
+	for i := range agents {
+		agents[i] = strings.TrimSpace(agents[i])
+	}
+	return agents
+}
+
+// detectBlockedPage reports whether the page text looks like a bot wall or
+// an empty page. Markers only count on short pages so that real articles
+// mentioning "captcha" are not flagged
+func detectBlockedPage(text string) (bool, string) {
+	text = strings.TrimSpace(text)
+	if len(text) < 20 {
+		return true, "blank page"
+	}
+	if len(text) > 2000 {
+		return false, ""
+	}
+	lower := strings.ToLower(text)
+	for _, marker := range botWallMarkers {
+		if strings.Contains(lower, marker) {
+			return true, fmt.Sprintf("bot wall (%q)", marker)
+		}
+	}
+	return false, ""
+}